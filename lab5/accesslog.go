@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	defaultAccessLogMaxSize = 100 * 1024 * 1024
+	defaultAccessLogMaxAge  = 24 * time.Hour
+	defaultAccessLogKeep    = 7
+)
+
+// accessRecord is the line written to the access log when a session closes.
+type accessRecord struct {
+	Time      time.Time `json:"time"`
+	Session   uint64    `json:"session"`
+	Client    string    `json:"client"`
+	User      string    `json:"user,omitempty"`
+	Protocol  string    `json:"protocol,omitempty"`
+	Host      string    `json:"host,omitempty"`
+	Name      string    `json:"server_name,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	Port      uint16    `json:"port,omitempty"`
+	Upstream  string    `json:"upstream,omitempty"`
+	Reply     *int      `json:"reply,omitempty"`
+	Duration  float64   `json:"duration"`
+	BytesUp   int64     `json:"bytes_up"`
+	BytesDown int64     `json:"bytes_down"`
+	Reason    string    `json:"reason"`
+}
+
+// accessLog writes JSON lines to a file and rotates it once it is larger than
+// maxSize or older than maxAge. Rotated files get a timestamp suffix, only the
+// newest keep of them are kept. Zero disables each of the three.
+type accessLog struct {
+	path    string
+	file    *os.File
+	size    int64
+	opened  time.Time
+	maxSize int64
+	maxAge  time.Duration
+	keep    int
+}
+
+func openAccessLog(path string) (*accessLog, error) {
+	l := &accessLog{path: path}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// open continues an existing file, its age counts from now.
+func (l *accessLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file, l.size, l.opened = f, fi.Size(), time.Now()
+	return nil
+}
+
+func (l *accessLog) write(rec *accessRecord) {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		errorf("Access log: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	if l.size > 0 && (l.maxSize > 0 && l.size+int64(len(line)) > l.maxSize ||
+		l.maxAge > 0 && time.Since(l.opened) >= l.maxAge) {
+		if err := l.rotate(); err != nil {
+			errorf("Access log rotation failed: %v", err)
+		}
+	}
+	if l.file == nil {
+		return
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		errorf("Access log: %v", err)
+	}
+}
+
+func (l *accessLog) rotate() error {
+	l.file.Close()
+	l.file = nil
+
+	rotated := l.path + "." + time.Now().Format("20060102-150405")
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(rotated); os.IsNotExist(err) {
+			break
+		}
+		rotated = fmt.Sprintf("%s.%s-%d", l.path, time.Now().Format("20060102-150405"), i)
+	}
+	if err := os.Rename(l.path, rotated); err != nil {
+		// Keep writing to the old file rather than losing records.
+		if openErr := l.open(); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+	if err := l.open(); err != nil {
+		return err
+	}
+	return l.removeOld()
+}
+
+// removeOld deletes rotated files beyond the newest keep.
+func (l *accessLog) removeOld() error {
+	if l.keep <= 0 {
+		return nil
+	}
+	rotated, err := filepath.Glob(l.path + ".2*")
+	if err != nil || len(rotated) <= l.keep {
+		return err
+	}
+	// The timestamps sort in time order.
+	sort.Strings(rotated)
+	for _, name := range rotated[:len(rotated)-l.keep] {
+		if err := os.Remove(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *accessLog) close() {
+	if l != nil && l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+}
+
+func (c *ClientConn) protocol() string {
+	switch c.version {
+	case socksVersion4:
+		return "socks4"
+	case socksVersion5:
+		return "socks5"
+	case protoHTTP:
+		return "http"
+	}
+	return ""
+}
+
+// noteClose records why the session ends, the first reason given wins.
+func (c *ClientConn) noteClose(reason string) {
+	if c.closeReason == "" {
+		c.closeReason = reason
+	}
+}
+
+// logAccess writes the record of a closing session.
+func (p *Proxy) logAccess(client *ClientConn) {
+	if p.accessLog == nil {
+		return
+	}
+	now := time.Now()
+	rec := &accessRecord{
+		Time:      now,
+		Session:   client.id,
+		User:      client.user,
+		Protocol:  client.protocol(),
+		Host:      client.targetHost,
+		Name:      client.serverName,
+		Port:      client.targetPort,
+		Duration:  now.Sub(client.started).Seconds(),
+		BytesUp:   client.relayed[dirUpload],
+		BytesDown: client.relayed[dirDownload],
+		Reason:    client.closeReason,
+	}
+	if client.clientAddr != nil {
+		rec.Client = client.clientAddr.String()
+	}
+	if client.upstream != nil {
+		rec.Upstream = client.upstream.name
+	}
+	if client.remoteIP != nil {
+		rec.IP = client.remoteIP.String()
+	}
+	if client.replied {
+		reply := client.reply
+		rec.Reply = &reply
+	}
+	if rec.Reason == "" {
+		rec.Reason = "closed"
+	}
+	p.accessLog.write(rec)
+}
+
+// setAccessLog switches to the access log of the configuration, keeping the
+// current file if the path did not change.
+func (p *Proxy) setAccessLog(l *accessLog, cfg *Config) {
+	if p.accessLog != nil && l != nil && p.accessLog.path == l.path {
+		l.close()
+		l = p.accessLog
+	} else {
+		p.accessLog.close()
+		p.accessLog = l
+	}
+	if l != nil {
+		l.maxSize, l.maxAge, l.keep = cfg.AccessLog.MaxSize, cfg.AccessLog.MaxAge, cfg.AccessLog.Keep
+	}
+}
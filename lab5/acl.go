@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// aclRule is one line of the rules file. Empty conditions match anything.
+type aclRule struct {
+	line    int
+	text    string
+	allow   bool
+	from    []*net.IPNet
+	users   []string
+	to      []*net.IPNet
+	domains []string
+	names   []string
+	portMin uint16
+	portMax uint16
+}
+
+// ACL is an ordered list of rules, the first matching rule decides.
+// A destination no rule matches is denied.
+type ACL struct {
+	rules []*aclRule
+}
+
+// aclRequest describes a connection being checked. ip is nil while a name is not resolved yet,
+// or for good if unresolved is set because an upstream proxy resolves it. name is the
+// server name the client sent once nameKnown is set, see sniff.
+type aclRequest struct {
+	client     net.IP
+	user       string
+	host       string
+	ip         net.IP
+	unresolved bool
+	port       uint16
+	name       string
+	nameKnown  bool
+}
+
+// LoadACL reads a rules file with one rule per line:
+//
+//	allow|deny [from CIDR,...] [user NAME,...] [to CIDR|DOMAIN,...] [name DOMAIN,...] [port N|N-M]
+//
+// DOMAIN is either a glob such as "*.example.com" or a suffix such as ".example.com",
+// which also matches example.com itself. "name" matches the TLS SNI or HTTP Host the
+// client sends after connecting, a session without one never matches it. Until the
+// name is known such rules are skipped, so the rules without "name" decide whether to
+// connect at all, and the name can only refuse the session afterwards.
+// Empty lines and lines starting with '#' are ignored.
+func LoadACL(filename string) (*ACL, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	acl := &ACL{}
+
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule, err := parseACLRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", filename, lineNum, err)
+		}
+		rule.line = lineNum
+		acl.rules = append(acl.rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return acl, nil
+}
+
+func parseACLRule(line string) (*aclRule, error) {
+	fields := strings.Fields(line)
+	rule := &aclRule{text: line, portMax: 65535}
+
+	switch fields[0] {
+	case "allow":
+		rule.allow = true
+	case "deny":
+	default:
+		return nil, fmt.Errorf("rule must start with allow or deny, not %q", fields[0])
+	}
+
+	fields = fields[1:]
+	for len(fields) > 0 {
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("missing value after %q", fields[0])
+		}
+		key, values := fields[0], strings.Split(fields[1], ",")
+		fields = fields[2:]
+
+		switch key {
+		case "from":
+			for _, value := range values {
+				network, err := parseCIDR(value)
+				if err != nil {
+					return nil, err
+				}
+				rule.from = append(rule.from, network)
+			}
+		case "user":
+			rule.users = append(rule.users, values...)
+		case "to":
+			for _, value := range values {
+				if network, err := parseCIDR(value); err == nil {
+					rule.to = append(rule.to, network)
+					continue
+				}
+				pattern, err := parseDomainPattern(value)
+				if err != nil {
+					return nil, err
+				}
+				rule.domains = append(rule.domains, pattern)
+			}
+		case "name":
+			for _, value := range values {
+				pattern, err := parseDomainPattern(value)
+				if err != nil {
+					return nil, err
+				}
+				rule.names = append(rule.names, pattern)
+			}
+		case "port":
+			var err error
+			rule.portMin, rule.portMax, err = parsePortRange(values[0])
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unknown condition %q", key)
+		}
+	}
+
+	return rule, nil
+}
+
+func parseDomainPattern(value string) (string, error) {
+	if _, err := path.Match(value, ""); err != nil {
+		return "", fmt.Errorf("bad domain pattern %q", value)
+	}
+	return strings.ToLower(strings.TrimSuffix(value, ".")), nil
+}
+
+// parseCIDR accepts a network in CIDR notation or a single address.
+func parseCIDR(value string) (*net.IPNet, error) {
+	if ip := net.ParseIP(value); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(value)
+	return network, err
+}
+
+func parsePortRange(value string) (uint16, uint16, error) {
+	loStr, hiStr, isRange := strings.Cut(value, "-")
+	if !isRange {
+		hiStr = loStr
+	}
+	lo, err := strconv.ParseUint(loStr, 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("bad port %q", value)
+	}
+	hi, err := strconv.ParseUint(hiStr, 10, 16)
+	if err != nil || hi < lo {
+		return 0, 0, fmt.Errorf("bad port range %q", value)
+	}
+	return uint16(lo), uint16(hi), nil
+}
+
+// check returns the rule deciding req. decided is false if that needs the resolved
+// address, which happens when a rule with a "to" network is reached before resolution.
+func (a *ACL) check(req aclRequest) (rule *aclRule, decided bool) {
+	for _, rule := range a.rules {
+		matched, known := rule.match(req)
+		if !known {
+			return nil, false
+		}
+		if matched {
+			return rule, true
+		}
+	}
+	return nil, true
+}
+
+func (r *aclRule) match(req aclRequest) (matched, known bool) {
+	if len(r.from) > 0 && !containsIP(r.from, req.client) {
+		return false, true
+	}
+	if len(r.users) > 0 && !r.matchUser(req.user) {
+		return false, true
+	}
+	if req.port < r.portMin || req.port > r.portMax {
+		return false, true
+	}
+	if len(r.names) > 0 && (!req.nameKnown || !matchDomain(r.names, req.name)) {
+		return false, true
+	}
+
+	if len(r.to) == 0 && len(r.domains) == 0 {
+		return true, true
+	}
+	if matchDomain(r.domains, req.host) {
+		return true, true
+	}
+	if len(r.to) == 0 {
+		return false, true
+	}
+	if req.ip == nil {
+		return false, req.unresolved
+	}
+	return containsIP(r.to, req.ip), true
+}
+
+func (r *aclRule) matchUser(user string) bool {
+	for _, u := range r.users {
+		if u == user || u == "*" && user != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func matchDomain(patterns []string, host string) bool {
+	if host == "" || net.ParseIP(host) != nil {
+		return false
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, ".") {
+			if host == pattern[1:] || strings.HasSuffix(host, pattern) {
+				return true
+			}
+			continue
+		}
+		if ok, _ := path.Match(pattern, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address the client connected from.
+func (c *ClientConn) clientIP() net.IP {
+	if c.clientAddr != nil {
+		return c.clientAddr.IP
+	}
+	return nil
+}
+
+// allowed checks a destination of client against the rules and writes an audit line
+// for denials. ip is nil if host is not resolved yet, in which case allowed may
+// answer true and the addresses are checked again after resolution.
+func (p *Proxy) allowed(client *ClientConn, host string, ip net.IP, port uint16) bool {
+	if p.acl == nil {
+		return true
+	}
+
+	req := aclRequest{client: client.clientIP(), user: client.user, host: host, ip: ip,
+		unresolved: client.upstream != nil, port: port, name: client.serverName, nameKnown: client.nameKnown}
+	rule, decided := p.acl.check(req)
+	if !decided {
+		return true
+	}
+	if rule != nil && rule.allow {
+		return true
+	}
+
+	reason := "no matching rule"
+	if rule != nil {
+		reason = fmt.Sprintf("rule %d %q", rule.line, rule.text)
+	}
+	dest := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	if ip != nil && host != ip.String() {
+		dest += " (" + ip.String() + ")"
+	}
+	if client.serverName != "" {
+		dest += " name " + client.serverName
+	}
+	metrics.rejected.add("acl", 1)
+	warnf("ACL: denied client %d from %s%s to %s by %s", client.clientFd, req.client, client.userTag(), dest, reason)
+	return false
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+var errAdminClosed = errors.New("closed by administrator")
+
+// sessionInfo describes a session in the admin API. Sessions are identified
+// by their id, FD is the client connection as named in the log.
+type sessionInfo struct {
+	ID        uint64    `json:"id"`
+	FD        int       `json:"fd"`
+	Client    string    `json:"client"`
+	User      string    `json:"user,omitempty"`
+	Stage     string    `json:"stage"`
+	Target    string    `json:"target,omitempty"`
+	Name      string    `json:"server_name,omitempty"`
+	Upstream  string    `json:"upstream,omitempty"`
+	Capture   string    `json:"capture,omitempty"`
+	Started   time.Time `json:"started"`
+	BytesUp   int64     `json:"bytes_up"`
+	BytesDown int64     `json:"bytes_down"`
+	// Smoothed round trip times from TCP_INFO in microseconds.
+	ClientRTT uint32 `json:"client_rtt_us,omitempty"`
+	RemoteRTT uint32 `json:"remote_rtt_us,omitempty"`
+}
+
+// dnsQueryInfo describes a DNS query in flight.
+type dnsQueryInfo struct {
+	Name     string    `json:"name"`
+	Type     string    `json:"type"`
+	Started  time.Time `json:"started"`
+	Attempt  int       `json:"attempt"`
+	Upstream string    `json:"upstream"`
+	TCP      bool      `json:"tcp"`
+	Waiters  int       `json:"waiters"`
+}
+
+// serveHTTP serves handler on addr until the returned server is closed.
+func serveHTTP(addr string, handler http.Handler) (*http.Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			errorf("HTTP server on %s failed: %v", addr, err)
+		}
+	}()
+	return server, nil
+}
+
+// serveAdmin serves the admin API on addr:
+//
+//	GET    /sessions                list sessions
+//	DELETE /sessions/{id}           close a session
+//	DELETE /users/{user}/sessions   close every session of a user
+//	POST   /sessions/{id}/capture   start capturing a session
+//	DELETE /sessions/{id}/capture   stop capturing a session
+//	GET    /dns                     list DNS queries in flight
+//
+// It has no authentication of its own and should listen on loopback only.
+func (p *Proxy) serveAdmin(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /sessions", p.adminSessions)
+	mux.HandleFunc("DELETE /sessions/{id}", p.adminCloseSession)
+	mux.HandleFunc("DELETE /users/{user}/sessions", p.adminCloseUser)
+	mux.HandleFunc("POST /sessions/{id}/capture", p.adminCapture)
+	mux.HandleFunc("DELETE /sessions/{id}/capture", p.adminCapture)
+	mux.HandleFunc("GET /dns", p.adminDNS)
+
+	server, err := serveHTTP(addr, mux)
+	if err != nil {
+		return err
+	}
+	p.adminAddr = addr
+	p.adminServer = server
+	return nil
+}
+
+func (p *Proxy) closeAdmin() {
+	if p.adminServer != nil {
+		p.adminServer.Close()
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func (p *Proxy) adminSessions(w http.ResponseWriter, r *http.Request) {
+	sessions := []sessionInfo{}
+	err := p.call(func() error {
+		for fd, client := range p.conns {
+			if fd == client.clientFd {
+				sessions = append(sessions, client.info())
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		writeJSONError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Started.Before(sessions[j].Started) })
+	writeJSON(w, http.StatusOK, sessions)
+}
+
+func (p *Proxy) adminCloseSession(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, errors.New("session id must be a number"))
+		return
+	}
+	found := false
+	err = p.call(func() error {
+		client := p.sessionByID(id)
+		if client == nil {
+			return nil
+		}
+		found = true
+		warnf("Client %d%s closed: %v", client.clientFd, client.userTag(), errAdminClosed)
+		client.noteClose(errAdminClosed.Error())
+		p.closeClient(client.clientFd)
+		return nil
+	})
+	switch {
+	case err != nil:
+		writeJSONError(w, http.StatusServiceUnavailable, err)
+	case !found:
+		writeJSONError(w, http.StatusNotFound, errors.New("no such session"))
+	default:
+		writeJSON(w, http.StatusOK, map[string]int{"closed": 1})
+	}
+}
+
+// adminCapture starts or stops capturing a session depending on the method.
+func (p *Proxy) adminCapture(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, errors.New("session id must be a number"))
+		return
+	}
+	var path string
+	found := false
+	err = p.call(func() error {
+		client := p.sessionByID(id)
+		if client == nil {
+			return nil
+		}
+		found = true
+		if r.Method == http.MethodDelete {
+			if client.capture != nil {
+				path = client.capture.path
+			}
+			p.stopCapture(client)
+			return nil
+		}
+		if err := p.startCapture(client); err != nil {
+			return err
+		}
+		path = client.capture.path
+		return nil
+	})
+	switch {
+	case errors.Is(err, errProxyStopped):
+		writeJSONError(w, http.StatusServiceUnavailable, err)
+	case err != nil:
+		writeJSONError(w, http.StatusConflict, err)
+	case !found:
+		writeJSONError(w, http.StatusNotFound, errors.New("no such session"))
+	default:
+		writeJSON(w, http.StatusOK, map[string]string{"file": path})
+	}
+}
+
+func (p *Proxy) adminCloseUser(w http.ResponseWriter, r *http.Request) {
+	user := r.PathValue("user")
+	var closed int
+	err := p.call(func() error {
+		closed = p.closeUserSessions(user, errAdminClosed)
+		return nil
+	})
+	if err != nil {
+		writeJSONError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"closed": closed})
+}
+
+func (p *Proxy) adminDNS(w http.ResponseWriter, r *http.Request) {
+	var queries []dnsQueryInfo
+	err := p.call(func() error {
+		queries = p.resolver.inflightQueries()
+		return nil
+	})
+	if err != nil {
+		writeJSONError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	sort.Slice(queries, func(i, j int) bool { return queries[i].Started.Before(queries[j].Started) })
+	writeJSON(w, http.StatusOK, queries)
+}
+
+// sessionByID returns the open session with id, or nil.
+func (p *Proxy) sessionByID(id uint64) *ClientConn {
+	for fd, client := range p.conns {
+		if fd == client.clientFd && client.id == id {
+			return client
+		}
+	}
+	return nil
+}
+
+func (c *ClientConn) info() sessionInfo {
+	info := sessionInfo{
+		ID:        c.id,
+		FD:        c.clientFd,
+		User:      c.user,
+		Stage:     c.stage.String(),
+		Name:      c.serverName,
+		Started:   c.started,
+		BytesUp:   c.relayed[dirUpload],
+		BytesDown: c.relayed[dirDownload],
+		ClientRTT: tcpRTT(c.clientFd),
+	}
+	if c.clientAddr != nil {
+		info.Client = c.clientAddr.String()
+	}
+	if c.targetHost != "" {
+		info.Target = net.JoinHostPort(c.targetHost, strconv.Itoa(int(c.targetPort)))
+	}
+	if c.upstream != nil {
+		info.Upstream = c.upstream.name
+	}
+	if c.remoteFd != 0 {
+		info.RemoteRTT = tcpRTT(c.remoteFd)
+	}
+	if c.capture != nil {
+		info.Capture = c.capture.path
+	}
+	return info
+}
+
+// tcpRTT returns the smoothed RTT of a TCP socket in microseconds, or 0 if unknown.
+func tcpRTT(fd int) uint32 {
+	ti, err := unix.GetsockoptTCPInfo(fd, unix.IPPROTO_TCP, unix.TCP_INFO)
+	if err != nil {
+		return 0
+	}
+	return ti.Rtt
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	authNone         = 0x00
+	authUserPass     = 0x02
+	authNoAcceptable = 0xFF
+
+	userPassVersion = 0x01
+	userPassSuccess = 0x00
+	userPassFailure = 0x01
+)
+
+// Credentials holds the users allowed to pass RFC 1929 authentication.
+// Passwords are stored either as plain text or as bcrypt hashes.
+type Credentials struct {
+	users map[string]string
+	// Checked for unknown users, so the time taken does not tell which users exist.
+	dummy string
+}
+
+// LoadCredentials reads a credentials file with one "user:password" pair per line.
+// Empty lines and lines starting with '#' are ignored. A password starting with
+// "$2" is treated as a bcrypt hash.
+func LoadCredentials(path string) (*Credentials, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	creds := &Credentials{users: make(map[string]string)}
+
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		user, password, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("%s:%d: expected user:password", path, lineNum)
+		}
+		if len(user) > 255 || len(password) > 255 {
+			return nil, fmt.Errorf("%s:%d: user or password longer than 255 bytes", path, lineNum)
+		}
+		if _, dup := creds.users[user]; dup {
+			return nil, fmt.Errorf("%s:%d: duplicate user %q", path, lineNum, user)
+		}
+		creds.users[user] = password
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	dummy, err := dummyPassword(creds.users)
+	if err != nil {
+		return nil, err
+	}
+	creds.dummy = dummy
+	return creds, nil
+}
+
+// dummyPassword returns an unguessable password stored like the real ones,
+// hashed with the cost of the first bcrypt hash if there is one.
+func dummyPassword(users map[string]string) (string, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	for _, stored := range users {
+		if !isBcryptHash(stored) {
+			continue
+		}
+		cost, err := bcrypt.Cost([]byte(stored))
+		if err != nil {
+			continue
+		}
+		hash, err := bcrypt.GenerateFromPassword(random, cost)
+		if err != nil {
+			return "", err
+		}
+		return string(hash), nil
+	}
+	return fmt.Sprintf("%x", random), nil
+}
+
+func isBcryptHash(password string) bool {
+	return strings.HasPrefix(password, "$2")
+}
+
+// Verify reports whether the given user/password pair is known.
+// It may take long for bcrypt hashes, so the loop uses verifyLogin.
+func (c *Credentials) Verify(user, password string) bool {
+	stored, known := c.users[user]
+	if !known {
+		stored = c.dummy
+	}
+
+	var match bool
+	if isBcryptHash(stored) {
+		match = bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	} else {
+		match = subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+	}
+	return known && match
+}
+
+// verifyLogin checks the credentials on a worker goroutine and hands the
+// result to done on the loop, unless the client is gone by then. The
+// handshake of the client waits meanwhile and resumes after done.
+func (p *Proxy) verifyLogin(client *ClientConn, user, password string, done func(ok bool) error) {
+	creds := p.creds
+	client.verifying = true
+	go func() {
+		ok := creds.Verify(user, password)
+		p.tasks.post(func() {
+			client.verifying = false
+			if client.closed {
+				return
+			}
+			err := done(ok)
+			if err == nil {
+				err = p.processHandshake(client)
+			}
+			if err == nil && !client.closed {
+				err = p.updateInterest(client)
+			}
+			p.abortOnError(client, err)
+		})
+	}()
+}
+
+func (p *Proxy) handleLogin(client *ClientConn) error {
+	if len(client.buffer) < 2 {
+		return nil
+	}
+
+	if client.buffer[0] != userPassVersion {
+		return fmt.Errorf("unsupported auth version: %d", client.buffer[0])
+	}
+
+	userLen := int(client.buffer[1])
+	if len(client.buffer) < 3+userLen {
+		return nil
+	}
+
+	passLen := int(client.buffer[2+userLen])
+	if len(client.buffer) < 3+userLen+passLen {
+		return nil
+	}
+
+	user := string(client.buffer[2 : 2+userLen])
+	password := string(client.buffer[3+userLen : 3+userLen+passLen])
+
+	client.consume(3 + userLen + passLen)
+
+	p.verifyLogin(client, user, password, func(ok bool) error {
+		if !ok {
+			metrics.rejected.add("auth", 1)
+			response := []byte{userPassVersion, userPassFailure}
+			if err := p.sendToClient(client, response); err != nil {
+				return err
+			}
+			return fmt.Errorf("authentication failed for user %q", user)
+		}
+
+		if err := p.admitUser(client, user); err != nil {
+			response := []byte{userPassVersion, userPassFailure}
+			if sendErr := p.sendToClient(client, response); sendErr != nil {
+				return sendErr
+			}
+			return err
+		}
+
+		response := []byte{userPassVersion, userPassSuccess}
+		if err := p.sendToClient(client, response); err != nil {
+			return err
+		}
+
+		client.user = user
+		client.stage = request
+		infof("Client %d authenticated as %q", client.clientFd, user)
+		return nil
+	})
+	return nil
+}
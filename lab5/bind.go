@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// startBind opens the listening socket for a BIND request and sends the first reply.
+// expectIP is the peer the client announced, nil or unspecified accept any peer.
+func (p *Proxy) startBind(client *ClientConn, expectIP net.IP) error {
+	if expectIP != nil && expectIP.IsUnspecified() {
+		expectIP = nil
+	}
+	// Rules on the peer address are decided in acceptBind if it was not announced.
+	if !p.allowed(client, client.targetHost, expectIP, client.targetPort) {
+		return p.failRequest(client, fmt.Errorf("%w: BIND for %s:%d", errNotAllowed, client.targetHost, client.targetPort))
+	}
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: client.localAddr.IP})
+	if err != nil {
+		return err
+	}
+
+	bindFd, err := listenerFd(listener)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+
+	if err := unix.EpollCtl(p.epollFd, unix.EPOLL_CTL_ADD, bindFd, &unix.EpollEvent{
+		Events: unix.EPOLLIN,
+		Fd:     int32(bindFd),
+	}); err != nil {
+		listener.Close()
+		return err
+	}
+
+	client.bindExpect = expectIP
+	client.bindListener = listener
+	client.bindFd = bindFd
+	p.conns[bindFd] = client
+
+	bindAddr := listener.Addr().(*net.TCPAddr)
+	if err := p.sendReply(client, repSuccess, bindAddr.IP, bindAddr.Port); err != nil {
+		return err
+	}
+
+	client.stage = bindWait
+	p.armConnectTimeout(client)
+	infof("Client %d%s waiting for inbound connection on %s", client.clientFd, client.userTag(), bindAddr)
+	return nil
+}
+
+// acceptBind accepts the single inbound connection of a BIND request and starts relaying.
+func (p *Proxy) acceptBind(client *ClientConn) error {
+	remoteFd, peer, err := acceptTCP(client.bindFd)
+	if err != nil {
+		if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.ECONNABORTED) {
+			return nil
+		}
+		return err
+	}
+
+	if client.bindExpect != nil && !client.bindExpect.Equal(peer.IP) {
+		warnf("Client %d rejected inbound connection from %s, expected %s", client.clientFd, peer, client.bindExpect)
+		unix.Close(remoteFd)
+		return nil
+	}
+	// The peer port is ephemeral, rules see the announced one as for the request.
+	if !p.allowed(client, peer.IP.String(), peer.IP, client.targetPort) {
+		warnf("Client %d rejected inbound connection from %s", client.clientFd, peer)
+		unix.Close(remoteFd)
+		return nil
+	}
+
+	// Only one inbound connection is accepted per BIND.
+	p.closeBindListener(client)
+
+	if err := p.attachRemote(client, remoteFd); err != nil {
+		return err
+	}
+
+	client.remoteIP = peer.IP
+	if err := p.sendReply(client, repSuccess, peer.IP, peer.Port); err != nil {
+		return err
+	}
+
+	infof("Client %d%s accepted inbound connection from %s", client.clientFd, client.userTag(), peer)
+	return p.startRelay(client)
+}
+
+func (p *Proxy) closeBindListener(client *ClientConn) {
+	if client.bindListener == nil {
+		return
+	}
+	delete(p.conns, client.bindFd)
+	client.bindListener.Close()
+	client.bindListener = nil
+	client.bindFd = 0
+}
+
+func (p *Proxy) handleBindEvent(client *ClientConn, events uint32) error {
+	if events&(unix.EPOLLHUP|unix.EPOLLERR) != 0 {
+		return fmt.Errorf("bind listener error for client %d", client.clientFd)
+	}
+	if events&unix.EPOLLIN != 0 {
+		return p.acceptBind(client)
+	}
+	return nil
+}
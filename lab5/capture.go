@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const defaultCaptureMaxSize = 100 * 1024 * 1024
+
+// Relayed data is split into segments of at most this size.
+const captureSegmentSize = 32 * 1024
+
+var errCaptureDisabled = errors.New("capture.dir is not configured")
+
+// pcapng block types and the link type of bare IP packets.
+const (
+	pcapngSectionHeader   = 0x0A0D0D0A
+	pcapngInterface       = 0x00000001
+	pcapngEnhancedPacket  = 0x00000006
+	pcapngByteOrderMagic  = 0x1A2B3C4D
+	linkTypeRaw           = 101
+	tcpFlagFIN            = 0x01
+	tcpFlagSYN            = 0x02
+	tcpFlagPSH            = 0x08
+	tcpFlagACK            = 0x10
+	captureInitialSeq     = 0
+	captureIPv4HeaderSize = 20
+	captureIPv6HeaderSize = 40
+	captureTCPHeaderSize  = 20
+)
+
+// sessionCapture writes the relayed streams of one session to a pcapng file as a
+// TCP connection between the client and the target, as if there were no proxy.
+// Headers, handshake and close are synthesized, only the payload was seen.
+// Writing stops once the file reaches maxSize.
+type sessionCapture struct {
+	path    string
+	file    *os.File
+	w       *bufio.Writer
+	size    int64
+	maxSize int64
+	full    bool
+	// Endpoints indexed by direction, the source of dirUpload is the client.
+	ip   [2]net.IP
+	port [2]uint16
+	ipv6 bool
+	// Next sequence number sent in each direction.
+	seq [2]uint32
+}
+
+// parseCaptureRules reads capture rules, which take the conditions of ACL rules
+// without the leading allow or deny, e.g. "user alice port 443".
+func parseCaptureRules(lines []string) ([]*aclRule, error) {
+	var rules []*aclRule
+	for i, line := range lines {
+		rule, err := parseACLRule("allow " + strings.TrimSpace(line))
+		if err != nil {
+			return nil, fmt.Errorf("capture rule %d: %w", i+1, err)
+		}
+		rule.line = i + 1
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// maybeCapture starts capturing client if a capture rule matches it. Rules
+// matching on the server name are decided once sniff found it, so capturing
+// may start after the first data from the target.
+func (p *Proxy) maybeCapture(client *ClientConn) {
+	if client.capture != nil || len(p.captureRules) == 0 || p.cfg.Capture.Dir == "" {
+		return
+	}
+	req := aclRequest{client: client.clientIP(), user: client.user, host: client.targetHost,
+		ip: client.remoteIP, port: client.targetPort, name: client.serverName, nameKnown: client.nameKnown}
+	for _, rule := range p.captureRules {
+		if matched, known := rule.match(req); matched && known {
+			if err := p.startCapture(client); err != nil {
+				warnf("Client %d%s capture failed: %v", client.clientFd, client.userTag(), err)
+			}
+			return
+		}
+	}
+}
+
+// startCapture opens the capture file of client. Client data not relayed yet
+// is written right away.
+func (p *Proxy) startCapture(client *ClientConn) error {
+	cfg := p.cfg.Capture
+	if cfg.Dir == "" {
+		return errCaptureDisabled
+	}
+	if client.stage != establish || client.capture != nil {
+		return fmt.Errorf("client %d is not relaying or already captured", client.clientFd)
+	}
+
+	clientAddr := client.clientAddr
+	sa, err := unix.Getpeername(client.remoteFd)
+	if err != nil {
+		return err
+	}
+	remoteIP, remotePort := sockaddrToIP(sa)
+	if remoteIP == nil {
+		return errors.New("unknown remote address")
+	}
+
+	name := fmt.Sprintf("%s-session%d.pcapng", time.Now().Format("20060102-150405"), client.id)
+	c := &sessionCapture{
+		path:    filepath.Join(cfg.Dir, name),
+		maxSize: cfg.MaxSize,
+		ip:      [2]net.IP{clientAddr.IP, remoteIP},
+		port:    [2]uint16{uint16(clientAddr.Port), uint16(remotePort)},
+	}
+	if err := c.open(); err != nil {
+		return err
+	}
+	client.capture = c
+	infof("Client %d%s captured to %s", client.clientFd, client.userTag(), c.path)
+
+	c.data(dirUpload, client.toRemote)
+	return nil
+}
+
+// stopCapture finishes the capture of client, if any.
+func (p *Proxy) stopCapture(client *ClientConn) {
+	if client.capture == nil {
+		return
+	}
+	if err := client.capture.close(); err != nil {
+		warnf("Client %d capture: %v", client.clientFd, err)
+	}
+	client.capture = nil
+}
+
+func (c *sessionCapture) open() error {
+	if c.ip[0].To4() == nil || c.ip[1].To4() == nil {
+		// A mixed connection is written as IPv6 with IPv4-mapped addresses.
+		c.ipv6 = true
+		c.ip[0], c.ip[1] = c.ip[0].To16(), c.ip[1].To16()
+	} else {
+		c.ip[0], c.ip[1] = c.ip[0].To4(), c.ip[1].To4()
+	}
+
+	f, err := os.OpenFile(c.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o640)
+	if err != nil {
+		return err
+	}
+	c.file = f
+	c.w = bufio.NewWriter(f)
+
+	// Section header: byte order magic, version 1.0, unknown section length.
+	shb := binary.LittleEndian.AppendUint32(nil, pcapngByteOrderMagic)
+	shb = binary.LittleEndian.AppendUint16(shb, 1)
+	shb = binary.LittleEndian.AppendUint16(shb, 0)
+	shb = binary.LittleEndian.AppendUint64(shb, ^uint64(0))
+	c.block(pcapngSectionHeader, shb)
+
+	// One interface of raw IP packets without snap length.
+	idb := binary.LittleEndian.AppendUint16(nil, linkTypeRaw)
+	idb = binary.LittleEndian.AppendUint16(idb, 0)
+	idb = binary.LittleEndian.AppendUint32(idb, 0)
+	c.block(pcapngInterface, idb)
+
+	c.seq = [2]uint32{captureInitialSeq, captureInitialSeq}
+	c.packet(dirUpload, tcpFlagSYN, nil)
+	c.seq[dirUpload]++
+	c.packet(dirDownload, tcpFlagSYN|tcpFlagACK, nil)
+	c.seq[dirDownload]++
+	c.packet(dirUpload, tcpFlagACK, nil)
+	if err := c.w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return nil
+}
+
+// data records payload sent in dir. The last segment before maxSize is
+// shortened to fill the file.
+func (c *sessionCapture) data(dir int, payload []byte) {
+	headers := 20 + captureIPv4HeaderSize + captureTCPHeaderSize
+	if c.ipv6 {
+		headers = 20 + captureIPv6HeaderSize + captureTCPHeaderSize
+	}
+	for len(payload) > 0 && !c.full {
+		n := min(len(payload), captureSegmentSize)
+		if c.maxSize > 0 {
+			// Less up to 3 bytes of padding.
+			room := int(c.maxSize-c.size) - blockSize(headers) - 3
+			if room <= 0 {
+				c.stopFull()
+				return
+			}
+			n = min(n, room)
+		}
+		c.packet(dir, tcpFlagACK|tcpFlagPSH, payload[:n])
+		c.seq[dir] += uint32(n)
+		payload = payload[n:]
+	}
+}
+
+func (c *sessionCapture) close() error {
+	if !c.full {
+		c.packet(dirUpload, tcpFlagFIN|tcpFlagACK, nil)
+		c.seq[dirUpload]++
+		c.packet(dirDownload, tcpFlagFIN|tcpFlagACK, nil)
+		c.seq[dirDownload]++
+		c.packet(dirUpload, tcpFlagACK, nil)
+	}
+	err := c.w.Flush()
+	if closeErr := c.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// packet writes one synthesized TCP segment from the side dir stands for.
+func (c *sessionCapture) packet(dir int, flags byte, payload []byte) {
+	src, dst := dir, 1-dir
+
+	tcp := make([]byte, captureTCPHeaderSize, captureTCPHeaderSize+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], c.port[src])
+	binary.BigEndian.PutUint16(tcp[2:], c.port[dst])
+	binary.BigEndian.PutUint32(tcp[4:], c.seq[src])
+	if flags&tcpFlagACK != 0 {
+		binary.BigEndian.PutUint32(tcp[8:], c.seq[dst])
+	}
+	tcp[12] = (captureTCPHeaderSize / 4) << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 0xffff)
+	tcp = append(tcp, payload...)
+
+	var pkt []byte
+	var pseudo []byte
+	if c.ipv6 {
+		pkt = make([]byte, captureIPv6HeaderSize, captureIPv6HeaderSize+len(tcp))
+		pkt[0] = 0x60
+		binary.BigEndian.PutUint16(pkt[4:], uint16(len(tcp)))
+		pkt[6] = unix.IPPROTO_TCP
+		pkt[7] = 64
+		copy(pkt[8:], c.ip[src])
+		copy(pkt[24:], c.ip[dst])
+		pseudo = append(append([]byte(nil), c.ip[src]...), c.ip[dst]...)
+		pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(len(tcp)))
+		pseudo = append(pseudo, 0, 0, 0, unix.IPPROTO_TCP)
+	} else {
+		pkt = make([]byte, captureIPv4HeaderSize, captureIPv4HeaderSize+len(tcp))
+		pkt[0] = 0x45
+		binary.BigEndian.PutUint16(pkt[2:], uint16(captureIPv4HeaderSize+len(tcp)))
+		binary.BigEndian.PutUint16(pkt[6:], 0x4000) // don't fragment
+		pkt[8] = 64
+		pkt[9] = unix.IPPROTO_TCP
+		copy(pkt[12:], c.ip[src])
+		copy(pkt[16:], c.ip[dst])
+		binary.BigEndian.PutUint16(pkt[10:], checksum(0, pkt))
+		pseudo = append(append([]byte(nil), c.ip[src]...), c.ip[dst]...)
+		pseudo = append(pseudo, 0, unix.IPPROTO_TCP)
+		pseudo = binary.BigEndian.AppendUint16(pseudo, uint16(len(tcp)))
+	}
+	binary.BigEndian.PutUint16(tcp[16:], checksum(checksumAdd(0, pseudo), tcp))
+	pkt = append(pkt, tcp...)
+
+	// Enhanced packet block, timestamps in microseconds.
+	ts := uint64(time.Now().UnixMicro())
+	epb := binary.LittleEndian.AppendUint32(nil, 0)
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(ts>>32))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(ts))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(pkt)))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(pkt)))
+	epb = append(epb, pkt...)
+
+	if c.maxSize > 0 && c.size+int64(blockSize(len(epb))) > c.maxSize {
+		c.stopFull()
+		return
+	}
+	c.block(pcapngEnhancedPacket, epb)
+}
+
+func (c *sessionCapture) stopFull() {
+	c.full = true
+	infof("Capture %s reached %d bytes, stopped", c.path, c.maxSize)
+}
+
+// block writes a pcapng block with body padded to 32 bits.
+func (c *sessionCapture) block(typ uint32, body []byte) {
+	padded := (len(body) + 3) &^ 3
+	total := uint32(blockSize(len(body)))
+
+	buf := binary.LittleEndian.AppendUint32(make([]byte, 0, total), typ)
+	buf = binary.LittleEndian.AppendUint32(buf, total)
+	buf = append(buf, body...)
+	buf = append(buf, make([]byte, padded-len(body))...)
+	buf = binary.LittleEndian.AppendUint32(buf, total)
+
+	if _, err := c.w.Write(buf); err != nil {
+		errorf("Capture %s: %v", c.path, err)
+		c.full = true
+		return
+	}
+	c.size += int64(len(buf))
+}
+
+// blockSize is the size of a block with a body of n bytes: type, length twice and padding.
+func blockSize(n int) int {
+	return 12 + (n+3)&^3
+}
+
+// checksumAdd adds b to the ones' complement sum of 16 bit words.
+func checksumAdd(sum uint32, b []byte) uint32 {
+	for len(b) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	return sum
+}
+
+// checksum finishes the Internet checksum of b on top of a partial sum.
+func checksum(sum uint32, b []byte) uint16 {
+	sum = checksumAdd(sum, b)
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	defaultListen          = "127.0.0.1:1080"
+	defaultRelayBufferSize = 64 * 1024
+	// Handshakes are read through the relay buffer as well.
+	minRelayBufferSize = maxHandshakeSize
+	maxRelayBufferSize = 16 * 1024 * 1024
+
+	// Environment variables are named after the flags with this prefix,
+	// e.g. LAB5_DNS_CACHE for -dns-cache.
+	envPrefix = "LAB5_"
+)
+
+// Config is the proxy configuration. It is read from a YAML file, then
+// environment variables and command-line flags override single settings.
+type Config struct {
+	// Listen holds host:port addresses, IPv6 ones are bound IPv6-only
+	// so that [::]:1080 and 0.0.0.0:1080 can be used together.
+	Listen []string `yaml:"listen"`
+
+	// Control is the path of a Unix socket accepting commands such as "reload".
+	Control string `yaml:"control"`
+	// Metrics is the host:port serving Prometheus metrics at /metrics, disabled if empty.
+	Metrics string `yaml:"metrics"`
+	// Admin is the host:port of the HTTP API listing and closing sessions, disabled if empty.
+	// It has no authentication, keep it on loopback.
+	Admin string `yaml:"admin"`
+
+	DNS struct {
+		// Servers are host[:port] upstreams, /etc/resolv.conf is used if empty.
+		Servers    []string      `yaml:"servers"`
+		Timeout    time.Duration `yaml:"timeout"`
+		Attempts   int           `yaml:"attempts"`
+		CacheSize  int           `yaml:"cache_size"`
+		PreferIPv4 bool          `yaml:"prefer_ipv4"`
+	} `yaml:"dns"`
+
+	Buffers struct {
+		// Relay is the per-direction buffer of a session.
+		Relay int `yaml:"relay"`
+	} `yaml:"buffers"`
+
+	// Limits are off when zero.
+	Limits struct {
+		MaxSessions int `yaml:"max_sessions"`
+		PerIP       int `yaml:"per_ip"`
+		PerUser     int `yaml:"per_user"`
+		// Rate is the number of new connections per second a source IP may open,
+		// with bursts of up to Burst.
+		Rate  float64 `yaml:"rate"`
+		Burst int     `yaml:"burst"`
+	} `yaml:"limits"`
+
+	// Bandwidth is in bytes per second and direction, zero is unlimited.
+	Bandwidth struct {
+		Global     int64 `yaml:"global"`
+		PerUser    int64 `yaml:"per_user"`
+		PerSession int64 `yaml:"per_session"`
+	} `yaml:"bandwidth"`
+
+	// Quotas limit the bytes a user may relay per calendar day and month, both
+	// directions together, zero is unlimited. Users overrides both per user.
+	Quotas struct {
+		File        string                `yaml:"file"`
+		Daily       int64                 `yaml:"daily"`
+		Monthly     int64                 `yaml:"monthly"`
+		CutSessions bool                  `yaml:"cut_sessions"`
+		Users       map[string]QuotaLimit `yaml:"users"`
+	} `yaml:"quotas"`
+
+	Timeouts struct {
+		// Handshake limits the time from accepting a client to its complete request.
+		Handshake time.Duration `yaml:"handshake"`
+		// Lookup limits resolving the target of a request, dns.timeout is per query attempt.
+		Lookup time.Duration `yaml:"lookup"`
+		// Connect limits connecting to the target, or waiting for the inbound connection of BIND.
+		Connect time.Duration `yaml:"connect"`
+		// Idle closes sessions without any traffic for this long.
+		Idle time.Duration `yaml:"idle"`
+		// Drain is how long established sessions may continue after a shutdown signal.
+		Drain time.Duration `yaml:"drain"`
+	} `yaml:"timeouts"`
+
+	// AccessLog writes a JSON line per closed session to File, disabled if empty.
+	// The file is rotated once it exceeds MaxSize bytes or is older than MaxAge,
+	// Keep rotated files are kept. Zero disables each of them.
+	AccessLog struct {
+		File    string        `yaml:"file"`
+		MaxSize int64         `yaml:"max_size"`
+		MaxAge  time.Duration `yaml:"max_age"`
+		Keep    int           `yaml:"keep"`
+	} `yaml:"access_log"`
+
+	// Capture writes the relayed streams of sessions matching one of Rules to
+	// pcapng files in Dir, up to MaxSize bytes per file. Rules use the conditions
+	// of ACL rules, e.g. "user alice port 443". The admin API can capture any session.
+	Capture struct {
+		Dir     string   `yaml:"dir"`
+		MaxSize int64    `yaml:"max_size"`
+		Rules   []string `yaml:"rules"`
+	} `yaml:"capture"`
+
+	// Upstreams are next-hop proxies by name. Routes send CONNECT requests through
+	// them, "NAME CONDITIONS" lines with the conditions of ACL rules such as
+	// "corp to .corp.example,10.0.0.0/8". The first matching route wins, NAME
+	// "direct" and requests no route matches connect directly. The upstream
+	// resolves the target, so "to" networks only match targets given as addresses.
+	Upstreams map[string]Upstream `yaml:"upstreams"`
+	Routes    []string            `yaml:"routes"`
+
+	Log struct {
+		Level string `yaml:"level"`
+	} `yaml:"log"`
+
+	Policy struct {
+		Credentials string `yaml:"credentials"`
+		ACL         string `yaml:"acl"`
+	} `yaml:"policy"`
+}
+
+// QuotaLimit is the daily and monthly quota of a single user in bytes.
+type QuotaLimit struct {
+	Daily   int64 `yaml:"daily"`
+	Monthly int64 `yaml:"monthly"`
+}
+
+// Upstream is a next-hop proxy of Type "socks5" or "http" at the host:port Address.
+// Username enables RFC 1929 authentication for SOCKS5 and Basic authentication for HTTP.
+type Upstream struct {
+	Type     string `yaml:"type"`
+	Address  string `yaml:"address"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+func defaultConfig() *Config {
+	cfg := &Config{Listen: []string{defaultListen}}
+	cfg.DNS.CacheSize = 1024
+	cfg.Buffers.Relay = defaultRelayBufferSize
+	cfg.Timeouts.Handshake = defaultHandshakeTimeout
+	cfg.Timeouts.Lookup = defaultLookupTimeout
+	cfg.Timeouts.Connect = defaultConnectTimeout
+	cfg.Timeouts.Idle = defaultIdleTimeout
+	cfg.Timeouts.Drain = defaultDrainTimeout
+	cfg.AccessLog.MaxSize = defaultAccessLogMaxSize
+	cfg.AccessLog.MaxAge = defaultAccessLogMaxAge
+	cfg.AccessLog.Keep = defaultAccessLogKeep
+	cfg.Capture.MaxSize = defaultCaptureMaxSize
+	cfg.Log.Level = "info"
+	return cfg
+}
+
+// LoadConfig builds the configuration from defaults, the file given by -config,
+// environment variables and flags, in increasing priority, and validates it.
+// Arguments after the flags are returned as a command for a running proxy.
+func LoadConfig(args []string) (*Config, []string, error) {
+	fs := flag.NewFlagSet("lab5", flag.ContinueOnError)
+	configPath := fs.String("config", "", "YAML configuration file")
+	fs.String("listen", "", "comma separated host:port addresses to listen on (default "+defaultListen+")")
+	fs.String("control", "", "Unix socket for commands to the running proxy")
+	fs.String("metrics", "", "host:port serving Prometheus metrics at /metrics")
+	fs.String("admin", "", "host:port serving the admin API for sessions and DNS queries")
+	fs.String("dns", "", "comma separated DNS upstreams, /etc/resolv.conf is used if empty")
+	fs.Duration("dns-timeout", 0, "timeout of a single DNS query attempt")
+	fs.Int("dns-attempts", 0, "attempts per DNS upstream")
+	fs.Int("dns-cache", 0, "number of cached DNS answers, 0 disables the cache (default 1024)")
+	fs.Bool("prefer-ipv4", false, "try IPv4 addresses first when connecting to names with both families")
+	fs.Int("relay-buffer", 0, "per-direction relay buffer size in bytes (default 65536)")
+	fs.Int("max-sessions", 0, "maximum number of concurrent sessions, 0 is unlimited")
+	fs.Int("max-sessions-per-ip", 0, "maximum number of concurrent sessions per source IP, 0 is unlimited")
+	fs.Int("max-sessions-per-user", 0, "maximum number of concurrent sessions per user, 0 is unlimited")
+	fs.Float64("rate", 0, "new connections per second allowed per source IP, 0 is unlimited")
+	fs.Int("burst", 0, "burst of new connections allowed per source IP above -rate")
+	fs.Int64("bandwidth", 0, "bytes per second and direction for all sessions together, 0 is unlimited")
+	fs.Int64("bandwidth-per-user", 0, "bytes per second and direction for the sessions of a user, 0 is unlimited")
+	fs.Int64("bandwidth-per-session", 0, "bytes per second and direction for a single session, 0 is unlimited")
+	fs.String("quota-file", "", "file keeping the traffic of each user across restarts")
+	fs.Int64("quota-daily", 0, "bytes a user may relay per day, 0 is unlimited")
+	fs.Int64("quota-monthly", 0, "bytes a user may relay per month, 0 is unlimited")
+	fs.Bool("quota-cut", false, "close the sessions of a user once the quota is used up")
+	fs.Duration("handshake-timeout", 0, "time a client has for its complete request, 0 disables (default 10s)")
+	fs.Duration("lookup-timeout", 0, "time resolving a target may take, 0 disables (default 10s)")
+	fs.Duration("connect-timeout", 0, "time connecting to a target may take, 0 disables (default 30s)")
+	fs.Duration("idle-timeout", 0, "close sessions without traffic for this long, 0 disables (default 5m)")
+	fs.Duration("drain-timeout", 0, "how long sessions may finish after SIGTERM or SIGINT (default 30s)")
+	fs.String("access-log", "", "file receiving a JSON line per closed session")
+	fs.Int64("access-log-max-size", 0, "rotate the access log beyond this many bytes (default 100 MiB)")
+	fs.Duration("access-log-max-age", 0, "rotate the access log after this long (default 24h)")
+	fs.Int("access-log-keep", 0, "number of rotated access logs to keep (default 7)")
+	fs.String("capture-dir", "", "directory for pcapng captures of sessions")
+	fs.Int64("capture-max-size", 0, "stop capturing a session at this file size (default 100 MiB)")
+	fs.String("upstream", "", "socks5:// or http:// URL of a proxy for requests no route connects otherwise")
+	fs.String("log-level", "", "debug, info, warn or error (default info)")
+	fs.String("credentials", "", "file with user:password lines enabling username/password auth")
+	fs.String("acl", "", "file with allow/deny rules for destinations, everything is allowed if empty")
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	// Environment variables fill in flags missing on the command line.
+	onCommandLine := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { onCommandLine[f.Name] = true })
+	var envErr error
+	fs.VisitAll(func(f *flag.Flag) {
+		name := envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		value, ok := os.LookupEnv(name)
+		if onCommandLine[f.Name] || !ok || envErr != nil {
+			return
+		}
+		if err := fs.Set(f.Name, value); err != nil {
+			envErr = fmt.Errorf("%s: %w", name, err)
+		}
+	})
+	if envErr != nil {
+		return nil, nil, envErr
+	}
+
+	cfg := defaultConfig()
+	if *configPath != "" {
+		if err := cfg.load(*configPath); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var overrideErr error
+	fs.Visit(func(f *flag.Flag) {
+		if err := cfg.override(f); err != nil && overrideErr == nil {
+			overrideErr = fmt.Errorf("-%s: %w", f.Name, err)
+		}
+	})
+	if overrideErr != nil {
+		return nil, nil, overrideErr
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, nil, err
+	}
+	return cfg, fs.Args(), nil
+}
+
+func (c *Config) load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+func (c *Config) override(f *flag.Flag) error {
+	value := f.Value.String()
+	getter := f.Value.(flag.Getter)
+
+	switch f.Name {
+	case "config":
+	case "listen":
+		c.Listen = parseServers(value)
+	case "control":
+		c.Control = value
+	case "metrics":
+		c.Metrics = value
+	case "admin":
+		c.Admin = value
+	case "dns":
+		c.DNS.Servers = parseServers(value)
+	case "dns-timeout":
+		c.DNS.Timeout = getter.Get().(time.Duration)
+	case "dns-attempts":
+		c.DNS.Attempts = getter.Get().(int)
+	case "dns-cache":
+		c.DNS.CacheSize = getter.Get().(int)
+	case "prefer-ipv4":
+		c.DNS.PreferIPv4 = getter.Get().(bool)
+	case "relay-buffer":
+		c.Buffers.Relay = getter.Get().(int)
+	case "max-sessions":
+		c.Limits.MaxSessions = getter.Get().(int)
+	case "max-sessions-per-ip":
+		c.Limits.PerIP = getter.Get().(int)
+	case "max-sessions-per-user":
+		c.Limits.PerUser = getter.Get().(int)
+	case "rate":
+		c.Limits.Rate = getter.Get().(float64)
+	case "burst":
+		c.Limits.Burst = getter.Get().(int)
+	case "bandwidth":
+		c.Bandwidth.Global = getter.Get().(int64)
+	case "bandwidth-per-user":
+		c.Bandwidth.PerUser = getter.Get().(int64)
+	case "bandwidth-per-session":
+		c.Bandwidth.PerSession = getter.Get().(int64)
+	case "quota-file":
+		c.Quotas.File = getter.Get().(string)
+	case "quota-daily":
+		c.Quotas.Daily = getter.Get().(int64)
+	case "quota-monthly":
+		c.Quotas.Monthly = getter.Get().(int64)
+	case "quota-cut":
+		c.Quotas.CutSessions = getter.Get().(bool)
+	case "handshake-timeout":
+		c.Timeouts.Handshake = getter.Get().(time.Duration)
+	case "lookup-timeout":
+		c.Timeouts.Lookup = getter.Get().(time.Duration)
+	case "connect-timeout":
+		c.Timeouts.Connect = getter.Get().(time.Duration)
+	case "idle-timeout":
+		c.Timeouts.Idle = getter.Get().(time.Duration)
+	case "drain-timeout":
+		c.Timeouts.Drain = getter.Get().(time.Duration)
+	case "access-log":
+		c.AccessLog.File = value
+	case "access-log-max-size":
+		c.AccessLog.MaxSize = getter.Get().(int64)
+	case "access-log-max-age":
+		c.AccessLog.MaxAge = getter.Get().(time.Duration)
+	case "access-log-keep":
+		c.AccessLog.Keep = getter.Get().(int)
+	case "capture-dir":
+		c.Capture.Dir = value
+	case "capture-max-size":
+		c.Capture.MaxSize = getter.Get().(int64)
+	case "upstream":
+		upstream, err := parseUpstreamURL(value)
+		if err != nil {
+			return err
+		}
+		if c.Upstreams == nil {
+			c.Upstreams = make(map[string]Upstream)
+		}
+		c.Upstreams[defaultUpstream] = upstream
+		c.Routes = append(c.Routes, defaultUpstream)
+	case "log-level":
+		c.Log.Level = value
+	case "credentials":
+		c.Policy.Credentials = value
+	case "acl":
+		c.Policy.ACL = value
+	default:
+		return errors.New("flag not handled")
+	}
+	return nil
+}
+
+// validate reports the first invalid setting so the proxy never starts half configured.
+func (c *Config) validate() error {
+	if len(c.Listen) == 0 {
+		return errors.New("config: at least one listen address is required")
+	}
+	seen := make(map[string]bool)
+	for _, addr := range c.Listen {
+		host, portStr, err := net.SplitHostPort(addr)
+		if err != nil {
+			return fmt.Errorf("config: listen address %q: %w", addr, err)
+		}
+		if host != "" && net.ParseIP(host) == nil {
+			return fmt.Errorf("config: listen address %q: host must be an IP address", addr)
+		}
+		if port, err := strconv.Atoi(portStr); err != nil || port < 1 || port > 65535 {
+			return fmt.Errorf("config: listen address %q: bad port", addr)
+		}
+		if seen[addr] {
+			return fmt.Errorf("config: listen address %q given twice", addr)
+		}
+		seen[addr] = true
+	}
+
+	for name, addr := range map[string]string{"metrics": c.Metrics, "admin": c.Admin} {
+		if addr == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("config: %s address %q: %w", name, addr, err)
+		}
+	}
+
+	for _, server := range c.DNS.Servers {
+		host := server
+		if h, _, err := net.SplitHostPort(server); err == nil {
+			host = h
+		}
+		if net.ParseIP(host) == nil {
+			return fmt.Errorf("config: DNS upstream %q must be an IP address", server)
+		}
+	}
+	if c.DNS.Timeout < 0 {
+		return errors.New("config: dns.timeout must not be negative")
+	}
+	if c.DNS.Attempts < 0 {
+		return errors.New("config: dns.attempts must not be negative")
+	}
+	if c.DNS.CacheSize < 0 {
+		return errors.New("config: dns.cache_size must not be negative")
+	}
+
+	if c.Buffers.Relay < minRelayBufferSize || c.Buffers.Relay > maxRelayBufferSize {
+		return fmt.Errorf("config: buffers.relay must be between %d and %d", minRelayBufferSize, maxRelayBufferSize)
+	}
+
+	if c.Limits.MaxSessions < 0 || c.Limits.PerIP < 0 || c.Limits.PerUser < 0 || c.Limits.Rate < 0 || c.Limits.Burst < 0 {
+		return errors.New("config: limits must not be negative")
+	}
+
+	if c.Bandwidth.Global < 0 || c.Bandwidth.PerUser < 0 || c.Bandwidth.PerSession < 0 {
+		return errors.New("config: bandwidth must not be negative")
+	}
+
+	if c.Quotas.Daily < 0 || c.Quotas.Monthly < 0 {
+		return errors.New("config: quotas must not be negative")
+	}
+	for user, q := range c.Quotas.Users {
+		if q.Daily < 0 || q.Monthly < 0 {
+			return fmt.Errorf("config: quotas of user %q must not be negative", user)
+		}
+	}
+
+	if c.AccessLog.MaxSize < 0 || c.AccessLog.MaxAge < 0 || c.AccessLog.Keep < 0 {
+		return errors.New("config: access_log limits must not be negative")
+	}
+	if c.Capture.MaxSize < 0 {
+		return errors.New("config: capture.max_size must not be negative")
+	}
+
+	for name, u := range c.Upstreams {
+		if name == routeDirect {
+			return fmt.Errorf("config: upstream name %q is reserved", name)
+		}
+		if u.Type != upstreamSOCKS5 && u.Type != upstreamHTTP {
+			return fmt.Errorf("config: upstream %q: type must be %s or %s", name, upstreamSOCKS5, upstreamHTTP)
+		}
+		host, portStr, err := net.SplitHostPort(u.Address)
+		if err != nil || host == "" {
+			return fmt.Errorf("config: upstream %q: address %q must be host:port", name, u.Address)
+		}
+		if port, err := strconv.Atoi(portStr); err != nil || port < 1 || port > 65535 {
+			return fmt.Errorf("config: upstream %q: bad port", name)
+		}
+		if len(u.Username) > 255 || len(u.Password) > 255 {
+			return fmt.Errorf("config: upstream %q: username and password must not be longer than 255 bytes", name)
+		}
+	}
+
+	for name, d := range map[string]time.Duration{
+		"handshake": c.Timeouts.Handshake,
+		"lookup":    c.Timeouts.Lookup,
+		"connect":   c.Timeouts.Connect,
+		"idle":      c.Timeouts.Idle,
+		"drain":     c.Timeouts.Drain,
+	} {
+		if d < 0 {
+			return fmt.Errorf("config: timeouts.%s must not be negative", name)
+		}
+	}
+
+	if _, err := parseLogLevel(c.Log.Level); err != nil {
+		return fmt.Errorf("config: log.level: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/sys/unix"
+)
+
+// Delays from RFC 8305.
+const (
+	resolutionDelay        = 50 * time.Millisecond
+	connectionAttemptDelay = 250 * time.Millisecond
+)
+
+// dialState tracks the Happy Eyeballs race of a CONNECT request.
+type dialState struct {
+	// Where to connect, the target or the upstream proxy in front of it.
+	host string
+	port uint16
+	// Addresses not tried yet, per family.
+	ipv4 []net.IP
+	ipv6 []net.IP
+	// Connects in progress by socket.
+	attempts map[int]*net.TCPAddr
+
+	lookups    int
+	started    bool
+	startedAt  time.Time
+	lastIPv6   bool
+	delayTimer *timer
+	lastErr    error
+}
+
+// connectToRemote resolves the target of client if needed and races connects
+// to its addresses, see finishConnect for the winner. Requests routed to an
+// upstream proxy connect to the upstream instead, which resolves the target.
+func (p *Proxy) connectToRemote(client *ClientConn) error {
+	client.upstream = p.selectUpstream(client)
+	// CONNECT requests of every protocol end up here, so this is where the rules see
+	// the target first. BIND and UDP ASSOCIATE check their peers themselves.
+	ip := net.ParseIP(client.targetHost)
+	if !p.allowed(client, client.targetHost, ip, client.targetPort) {
+		return p.failRequest(client, fmt.Errorf("%w: %s:%d", errNotAllowed, client.targetHost, client.targetPort))
+	}
+
+	dial := &dialState{host: client.targetHost, port: client.targetPort, attempts: make(map[int]*net.TCPAddr)}
+	if u := client.upstream; u != nil {
+		dial.host, dial.port = u.host, u.port
+		ip = net.ParseIP(u.host)
+	}
+	// The first attempt goes to the preferred family.
+	dial.lastIPv6 = !p.preferIPv6()
+	client.dial = dial
+	client.stage = connecting
+
+	if ip != nil {
+		dial.add(ip)
+		return p.startDial(client)
+	}
+
+	p.armLookupTimeout(client)
+
+	dial.lookups = 2
+	for _, qtype := range []uint16{dns.TypeAAAA, dns.TypeA} {
+		if err := p.resolver.lookup(dial.host, qtype, func(msg *dns.Msg, err error) {
+			p.handleResolved(client, qtype, msg, err)
+		}); err != nil {
+			return p.failRequest(client, err)
+		}
+	}
+	return p.updateInterest(client)
+}
+
+func (p *Proxy) preferIPv6() bool {
+	return !p.preferIPv4
+}
+
+// handleResolved feeds the addresses of one lookup into the race of client.
+func (p *Proxy) handleResolved(client *ClientConn, qtype uint16, msg *dns.Msg, err error) {
+	dial := client.dial
+	if client.closed || dial == nil {
+		return
+	}
+	dial.lookups--
+
+	var ips []net.IP
+	if err == nil {
+		ips, err = answerIPs(dial.host, msg)
+	}
+	if err != nil {
+		// A denial from the other family explains the failure better.
+		if !errors.Is(dial.lastErr, errNotAllowed) {
+			dial.lastErr = err
+		}
+	} else {
+		debugf("DNS resolved %s %s -> %v", dial.host, dns.TypeToString[qtype], ips)
+	}
+
+	allowed := ips[:0]
+	for _, ip := range ips {
+		// The rules are about targets, not the upstream proxy in front of them.
+		if client.upstream == nil && !p.allowed(client, client.targetHost, ip, client.targetPort) {
+			dial.lastErr = fmt.Errorf("%w: %s:%d", errNotAllowed, ip, client.targetPort)
+			continue
+		}
+		dial.add(ip)
+		allowed = append(allowed, ip)
+	}
+	ips = allowed
+
+	if !dial.started {
+		preferred := (qtype == dns.TypeAAAA) == p.preferIPv6()
+		switch {
+		case dial.lookups == 0 || preferred && len(ips) > 0:
+			p.timers.stop(dial.delayTimer)
+			err = p.startDial(client)
+		case len(ips) > 0 && dial.delayTimer == nil:
+			// Give the preferred family a moment before racing without it.
+			dial.delayTimer = p.timers.after(resolutionDelay, func() {
+				dial.delayTimer = nil
+				if !client.closed && client.dial == dial && !dial.started {
+					p.abortOnError(client, p.startDial(client))
+				}
+			})
+			return
+		default:
+			return
+		}
+	} else {
+		err = p.continueDial(client)
+	}
+
+	p.abortOnError(client, err)
+}
+
+func (p *Proxy) abortOnError(client *ClientConn, err error) {
+	if err != nil {
+		warnf("Client %d request failed: %v", client.clientFd, err)
+		client.noteClose(err.Error())
+		p.closeClient(client.clientFd)
+	}
+}
+
+func (p *Proxy) startDial(client *ClientConn) error {
+	client.dial.started = true
+	client.dial.startedAt = time.Now()
+	p.armConnectTimeout(client)
+	return p.continueDial(client)
+}
+
+// continueDial starts the next attempt if nothing is in progress,
+// or fails the request once addresses and lookups are exhausted.
+func (p *Proxy) continueDial(client *ClientConn) error {
+	dial := client.dial
+	if len(dial.attempts) > 0 {
+		// The pending attempt timer picks up new addresses.
+		if dial.delayTimer == nil {
+			p.scheduleNextAttempt(client)
+		}
+		return nil
+	}
+
+	for dial.remaining() > 0 {
+		if err := p.startAttempt(client); err == nil {
+			return nil
+		}
+	}
+
+	if dial.lookups > 0 {
+		return nil
+	}
+	if dial.lastErr == nil {
+		dial.lastErr = fmt.Errorf("%w: no address for %s", errHostNotFound, dial.host)
+	}
+	return p.failRequest(client, dial.lastErr)
+}
+
+func (p *Proxy) scheduleNextAttempt(client *ClientConn) {
+	dial := client.dial
+	if dial.remaining() == 0 {
+		return
+	}
+	dial.delayTimer = p.timers.after(connectionAttemptDelay, func() {
+		dial.delayTimer = nil
+		if client.closed || client.dial != dial {
+			return
+		}
+		for dial.remaining() > 0 {
+			if err := p.startAttempt(client); err == nil {
+				return
+			}
+		}
+		if len(dial.attempts) == 0 {
+			p.abortOnError(client, p.continueDial(client))
+		}
+	})
+}
+
+// startAttempt starts a non-blocking connect to the next address of the race.
+func (p *Proxy) startAttempt(client *ClientConn) error {
+	dial := client.dial
+	ip := dial.next()
+	targetAddr := &net.TCPAddr{IP: ip, Port: int(dial.port)}
+	debugf("Connecting to %s", targetAddr)
+
+	family, sa := ipToSockaddr(ip, targetAddr.Port)
+	fd, err := unix.Socket(family, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		dial.lastErr = err
+		return err
+	}
+
+	if err := unix.Connect(fd, sa); err != nil && !errors.Is(err, unix.EINPROGRESS) {
+		unix.Close(fd)
+		dial.lastErr = fmt.Errorf("connect to %s failed: %w", targetAddr, err)
+		return dial.lastErr
+	}
+
+	if err := unix.EpollCtl(p.epollFd, unix.EPOLL_CTL_ADD, fd, &unix.EpollEvent{
+		Events: unix.EPOLLOUT,
+		Fd:     int32(fd),
+	}); err != nil {
+		unix.Close(fd)
+		dial.lastErr = err
+		return err
+	}
+
+	dial.attempts[fd] = targetAddr
+	p.conns[fd] = client
+	p.scheduleNextAttempt(client)
+	return nil
+}
+
+// finishConnect handles the outcome of one connect attempt. The first success wins the race.
+func (p *Proxy) finishConnect(client *ClientConn, fd int) error {
+	dial := client.dial
+	targetAddr := dial.attempts[fd]
+
+	soErr, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ERROR)
+	if err == nil && soErr != 0 {
+		err = unix.Errno(soErr)
+	}
+	if err != nil {
+		debugf("Connect to %s failed: %v", targetAddr, err)
+		dial.lastErr = fmt.Errorf("connect to %s failed: %w", targetAddr, err)
+		p.closeAttempt(client, fd)
+
+		// A failed attempt does not wait for the attempt delay.
+		p.timers.stop(dial.delayTimer)
+		dial.delayTimer = nil
+		for dial.remaining() > 0 {
+			if err := p.startAttempt(client); err == nil {
+				return nil
+			}
+		}
+		if len(dial.attempts) > 0 {
+			return nil
+		}
+		return p.continueDial(client)
+	}
+
+	delete(dial.attempts, fd)
+	p.abortDial(client)
+	client.remoteFd = fd
+	client.remoteEvents = unix.EPOLLOUT
+
+	if client.upstream != nil {
+		debugf("Connected to upstream %s at %s for %s:%d", client.upstream.name, targetAddr,
+			client.targetHost, client.targetPort)
+		return p.startUpstreamHandshake(client, dial.startedAt)
+	}
+	metrics.connectDuration.observe(time.Since(dial.startedAt))
+	client.remoteIP = targetAddr.IP
+	return p.establishRemote(client, targetAddr.String())
+}
+
+// establishRemote answers the request of client once the remote connection is
+// ready and starts relaying. via names where the connection goes for the log.
+func (p *Proxy) establishRemote(client *ClientConn, via string) error {
+	// BND.ADDR/BND.PORT is the local end of the outbound connection.
+	sa, err := unix.Getsockname(client.remoteFd)
+	if err != nil {
+		return p.failRequest(client, err)
+	}
+	localIP, localPort := sockaddrToIP(sa)
+	if localIP == nil {
+		return p.failRequest(client, errors.New("unexpected local address family"))
+	}
+
+	if err := p.sendReply(client, repSuccess, localIP, localPort); err != nil {
+		return err
+	}
+
+	infof("Connection established to %s:%d via %s", client.targetHost, client.targetPort, via)
+	return p.startRelay(client)
+}
+
+func (p *Proxy) closeAttempt(client *ClientConn, fd int) {
+	delete(client.dial.attempts, fd)
+	delete(p.conns, fd)
+	unix.Close(fd)
+}
+
+// abortDial closes the attempts still racing and forgets the dial state.
+func (p *Proxy) abortDial(client *ClientConn) {
+	dial := client.dial
+	if dial == nil {
+		return
+	}
+	for fd := range dial.attempts {
+		p.closeAttempt(client, fd)
+	}
+	p.timers.stop(dial.delayTimer)
+	client.dial = nil
+}
+
+func (d *dialState) add(ip net.IP) {
+	if ip.To4() != nil {
+		d.ipv4 = append(d.ipv4, ip)
+	} else {
+		d.ipv6 = append(d.ipv6, ip)
+	}
+}
+
+func (d *dialState) remaining() int {
+	return len(d.ipv4) + len(d.ipv6)
+}
+
+// next pops the next address, alternating between families while both have some left.
+func (d *dialState) next() net.IP {
+	useIPv6 := !d.lastIPv6
+	if len(d.ipv6) == 0 {
+		useIPv6 = false
+	} else if len(d.ipv4) == 0 {
+		useIPv6 = true
+	}
+
+	d.lastIPv6 = useIPv6
+	var ip net.IP
+	if useIPv6 {
+		ip, d.ipv6 = d.ipv6[0], d.ipv6[1:]
+	} else {
+		ip, d.ipv4 = d.ipv4[0], d.ipv4[1:]
+	}
+	return ip
+}
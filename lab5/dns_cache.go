@@ -0,0 +1,125 @@
+package main
+
+import (
+	"container/list"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Upper bound for how long any answer is kept, whatever its TTL says.
+const dnsCacheMaxTTL = 24 * time.Hour
+
+type dnsKey struct {
+	name  string
+	qtype uint16
+}
+
+func newDNSKey(name string, qtype uint16) dnsKey {
+	return dnsKey{name: strings.ToLower(dns.Fqdn(name)), qtype: qtype}
+}
+
+type dnsCacheEntry struct {
+	key     dnsKey
+	msg     *dns.Msg
+	expires time.Time
+}
+
+// dnsCache keeps positive and negative (RFC 2308) answers until their TTL runs out.
+// Once full, the least recently used entry is evicted.
+type dnsCache struct {
+	size    int
+	entries map[dnsKey]*list.Element
+	lru     *list.List
+
+	hits   uint64
+	misses uint64
+}
+
+func newDNSCache(size int) *dnsCache {
+	return &dnsCache{
+		size:    size,
+		entries: make(map[dnsKey]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func (c *dnsCache) get(key dnsKey, now time.Time) (*dns.Msg, bool) {
+	elem, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+
+	entry := elem.Value.(*dnsCacheEntry)
+	if !now.Before(entry.expires) {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		c.misses++
+		return nil, false
+	}
+
+	c.lru.MoveToFront(elem)
+	c.hits++
+	return entry.msg, true
+}
+
+func (c *dnsCache) stats() (hits, misses uint64, entries int) {
+	return c.hits, c.misses, c.lru.Len()
+}
+
+// put stores msg if it carries a usable TTL.
+func (c *dnsCache) put(key dnsKey, msg *dns.Msg, now time.Time) {
+	if c.size <= 0 {
+		return
+	}
+
+	ttl, ok := cacheTTL(msg)
+	if !ok {
+		return
+	}
+	entry := &dnsCacheEntry{key: key, msg: msg, expires: now.Add(ttl)}
+
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*dnsCacheEntry).key)
+	}
+}
+
+// cacheTTL returns how long msg may be cached. Answers use the smallest record TTL,
+// NXDOMAIN and NODATA use the SOA TTL capped by its MINIMUM field and are not cached without SOA.
+func cacheTTL(msg *dns.Msg) (time.Duration, bool) {
+	var ttl uint32
+	found := false
+
+	if msg.Rcode == dns.RcodeSuccess && len(msg.Answer) > 0 {
+		for _, rr := range msg.Answer {
+			if !found || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				found = true
+			}
+		}
+	} else if msg.Rcode == dns.RcodeSuccess || msg.Rcode == dns.RcodeNameError {
+		for _, rr := range msg.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				ttl = min(soa.Hdr.Ttl, soa.Minttl)
+				found = true
+				break
+			}
+		}
+	}
+
+	if !found || ttl == 0 {
+		return 0, false
+	}
+	return min(time.Duration(ttl)*time.Second, dnsCacheMaxTTL), true
+}
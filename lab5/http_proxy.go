@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// protoHTTP marks sessions in ClientConn.version that speak HTTP instead of SOCKS.
+const protoHTTP = 'H'
+
+// Headers that only apply to a single hop and are not forwarded (RFC 7230, section 6.1).
+// Transfer-Encoding is kept since the body is relayed as is.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Upgrade",
+}
+
+var errBadHTTPRequest = errors.New("malformed HTTP request")
+
+// looksLikeHTTP reports whether the first byte of a connection can start an HTTP method.
+func looksLikeHTTP(b byte) bool {
+	return b >= 'A' && b <= 'Z'
+}
+
+// handleHTTPRequest handles CONNECT tunnels and absolute-URI requests once the header is complete.
+// Plain requests are forwarded with Connection: close, so every session carries one request.
+func (p *Proxy) handleHTTPRequest(client *ClientConn) error {
+	headerEnd := bytes.Index(client.buffer, []byte("\r\n\r\n"))
+	if headerEnd < 0 {
+		return nil
+	}
+	headerLen := headerEnd + 4
+
+	reader := textproto.NewReader(bufio.NewReader(bytes.NewReader(client.buffer[:headerLen])))
+	requestLine, err := reader.ReadLine()
+	if err != nil {
+		return p.failHTTP(client, http.StatusBadRequest, fmt.Errorf("%w: %v", errBadHTTPRequest, err))
+	}
+	header, err := reader.ReadMIMEHeader()
+	if err != nil {
+		return p.failHTTP(client, http.StatusBadRequest, fmt.Errorf("%w: %v", errBadHTTPRequest, err))
+	}
+	client.consume(headerLen)
+
+	method, target, proto, ok := parseRequestLine(requestLine)
+	if !ok {
+		return p.failHTTP(client, http.StatusBadRequest, fmt.Errorf("%w: %q", errBadHTTPRequest, requestLine))
+	}
+
+	if p.creds == nil {
+		return p.proxyHTTPRequest(client, method, target, proto, header)
+	}
+
+	user, password, ok := proxyAuthorization(header.Get("Proxy-Authorization"))
+	if !ok {
+		metrics.rejected.add("auth", 1)
+		return p.failHTTP(client, http.StatusProxyAuthRequired, errors.New("HTTP proxy authentication failed"))
+	}
+	p.verifyLogin(client, user, password, func(ok bool) error {
+		if !ok {
+			metrics.rejected.add("auth", 1)
+			return p.failHTTP(client, http.StatusProxyAuthRequired, errors.New("HTTP proxy authentication failed"))
+		}
+		if err := p.admitUser(client, user); err != nil {
+			status := http.StatusTooManyRequests
+			if errors.Is(err, errQuotaExceeded) {
+				status = http.StatusForbidden
+			}
+			return p.failHTTP(client, status, err)
+		}
+		client.user = user
+		return p.proxyHTTPRequest(client, method, target, proto, header)
+	})
+	return nil
+}
+
+// proxyHTTPRequest connects to the target of a parsed and authorized request.
+func (p *Proxy) proxyHTTPRequest(client *ClientConn, method, target, proto string, header textproto.MIMEHeader) error {
+	var hostPort string
+	if method == http.MethodConnect {
+		hostPort = target
+	} else {
+		u, err := url.Parse(target)
+		if err != nil || u.Scheme != "http" || u.Host == "" {
+			return p.failRequest(client, fmt.Errorf("%w: only absolute http:// URIs are proxied", errCommandNotSupported))
+		}
+		hostPort = u.Host
+		if u.Port() == "" {
+			hostPort = net.JoinHostPort(u.Hostname(), "80")
+		}
+		client.httpForward = buildForwardHeader(method, u, proto, header)
+	}
+
+	host, portStr, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return p.failHTTP(client, http.StatusBadRequest, fmt.Errorf("%w: %v", errBadHTTPRequest, err))
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return p.failHTTP(client, http.StatusBadRequest, fmt.Errorf("%w: bad port %q", errBadHTTPRequest, portStr))
+	}
+
+	client.targetHost = host
+	client.targetPort = uint16(port)
+
+	infof("Client %d%s HTTP %s to %s:%d", client.clientFd, client.userTag(), method, host, port)
+	return p.connectToRemote(client)
+}
+
+func parseRequestLine(line string) (method, target, proto string, ok bool) {
+	method, rest, ok1 := strings.Cut(line, " ")
+	target, proto, ok2 := strings.Cut(rest, " ")
+	if !ok1 || !ok2 || !strings.HasPrefix(proto, "HTTP/1.") {
+		return "", "", "", false
+	}
+	return method, target, proto, true
+}
+
+// proxyAuthorization extracts the user and password of Basic Proxy-Authorization.
+func proxyAuthorization(auth string) (user, password string, ok bool) {
+	encoded, ok := strings.CutPrefix(auth, "Basic ")
+	if !ok {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
+
+// buildForwardHeader rewrites an absolute-URI request into origin form without hop-by-hop headers.
+func buildForwardHeader(method string, u *url.URL, proto string, header textproto.MIMEHeader) []byte {
+	// Headers named in Connection are hop-by-hop as well.
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			header.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+
+	host := header.Get("Host")
+	if host == "" {
+		host = u.Host
+	}
+	header.Del("Host")
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s %s\r\n", method, u.RequestURI(), proto)
+	fmt.Fprintf(&b, "Host: %s\r\n", host)
+
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range header[name] {
+			fmt.Fprintf(&b, "%s: %s\r\n", name, value)
+		}
+	}
+	b.WriteString("Connection: close\r\n\r\n")
+
+	return []byte(b.String())
+}
+
+// sendHTTPReply answers a CONNECT, or on success of a plain request queues the rewritten header.
+func (p *Proxy) sendHTTPReply(client *ClientConn, rep byte) error {
+	if rep == repSuccess {
+		if client.httpForward != nil {
+			client.toRemote = append(client.toRemote, client.httpForward...)
+			client.httpForward = nil
+			return nil
+		}
+		client.reply, client.replied = http.StatusOK, true
+		return p.sendToClient(client, []byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	}
+
+	status := http.StatusBadGateway
+	switch rep {
+	case repNotAllowed:
+		status = http.StatusForbidden
+	case repTTLExpired:
+		status = http.StatusGatewayTimeout
+	case repCommandNotSupported:
+		status = http.StatusNotImplemented
+	}
+	return p.sendHTTPError(client, status)
+}
+
+// failHTTP answers with an error status and returns err so the session gets closed.
+func (p *Proxy) failHTTP(client *ClientConn, status int, err error) error {
+	if sendErr := p.sendHTTPError(client, status); sendErr != nil {
+		return sendErr
+	}
+	return err
+}
+
+func (p *Proxy) sendHTTPError(client *ClientConn, status int) error {
+	var extra string
+	if status == http.StatusProxyAuthRequired {
+		extra = "Proxy-Authenticate: Basic realm=\"proxy\"\r\n"
+	}
+	client.reply, client.replied = status, true
+	body := http.StatusText(status) + "\n"
+	return p.sendToClient(client, fmt.Appendf(nil, "HTTP/1.1 %d %s\r\n%sContent-Type: text/plain\r\n"+
+		"Content-Length: %d\r\nConnection: close\r\n\r\n%s", status, http.StatusText(status), extra, len(body), body))
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Buckets that stayed full this long are forgotten.
+const bucketPruneInterval = time.Minute
+
+var errTooManySessions = errors.New("too many sessions")
+
+// tokenBucket allows rate events per second on average with bursts of up to burst.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = min(b.burst, b.tokens+elapsed*b.rate)
+	}
+	b.last = now
+}
+
+// take removes n tokens if that many are available.
+func (b *tokenBucket) take(n float64, now time.Time) bool {
+	b.refill(now)
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// sessionLimits counts sessions per source and user and rate limits new connections.
+// The limits themselves come from the configuration and may change on reload.
+type sessionLimits struct {
+	total   int
+	perIP   map[string]int
+	perUser map[string]int
+	buckets map[string]*tokenBucket
+	pruning *timer
+
+	rejectedTotal uint64
+	rejectedIP    uint64
+	rejectedUser  uint64
+	rejectedRate  uint64
+}
+
+func newSessionLimits() *sessionLimits {
+	return &sessionLimits{
+		perIP:   make(map[string]int),
+		perUser: make(map[string]int),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// admitClient counts a new connection from ip, or explains why it is refused.
+func (p *Proxy) admitClient(ip string) error {
+	l, cfg := p.limits, p.cfg.Limits
+	now := time.Now()
+
+	if cfg.Rate > 0 {
+		burst := float64(max(cfg.Burst, 1))
+		b, ok := l.buckets[ip]
+		if !ok {
+			b = newTokenBucket(cfg.Rate, burst, now)
+			l.buckets[ip] = b
+			p.schedulePruning()
+		}
+		b.rate, b.burst = cfg.Rate, burst
+		if !b.take(1, now) {
+			l.rejectedRate++
+			metrics.rejected.add("rate", 1)
+			return fmt.Errorf("%s exceeds %g new connections per second", ip, cfg.Rate)
+		}
+	}
+	if cfg.MaxSessions > 0 && l.total >= cfg.MaxSessions {
+		l.rejectedTotal++
+		metrics.rejected.add("max_sessions", 1)
+		return fmt.Errorf("%w: limit of %d reached", errTooManySessions, cfg.MaxSessions)
+	}
+	if cfg.PerIP > 0 && l.perIP[ip] >= cfg.PerIP {
+		l.rejectedIP++
+		metrics.rejected.add("per_ip", 1)
+		return fmt.Errorf("%w: %s has %d", errTooManySessions, ip, l.perIP[ip])
+	}
+
+	l.total++
+	l.perIP[ip]++
+	return nil
+}
+
+// admitUser counts an authenticated session of user, or refuses it.
+func (p *Proxy) admitUser(client *ClientConn, user string) error {
+	if err := p.checkQuota(user); err != nil {
+		metrics.rejected.add("quota", 1)
+		return err
+	}
+	l, limit := p.limits, p.cfg.Limits.PerUser
+	if limit > 0 && l.perUser[user] >= limit {
+		l.rejectedUser++
+		metrics.rejected.add("per_user", 1)
+		return fmt.Errorf("%w: user %q has %d", errTooManySessions, user, l.perUser[user])
+	}
+	l.perUser[user]++
+	client.countedUser = user
+	return nil
+}
+
+// releaseClient gives back what admitClient and admitUser counted for client.
+func (p *Proxy) releaseClient(client *ClientConn) {
+	l := p.limits
+	if client.countedIP != "" {
+		l.total--
+		if l.perIP[client.countedIP]--; l.perIP[client.countedIP] <= 0 {
+			delete(l.perIP, client.countedIP)
+		}
+	}
+	if client.countedUser != "" {
+		if l.perUser[client.countedUser]--; l.perUser[client.countedUser] <= 0 {
+			delete(l.perUser, client.countedUser)
+		}
+	}
+}
+
+// schedulePruning drops full buckets from time to time, a full bucket behaves
+// exactly like a new one.
+func (p *Proxy) schedulePruning() {
+	l := p.limits
+	if l.pruning != nil {
+		return
+	}
+	l.pruning = p.timers.after(bucketPruneInterval, func() {
+		l.pruning = nil
+		now := time.Now()
+		for ip, b := range l.buckets {
+			if b.refill(now); b.tokens >= b.burst {
+				delete(l.buckets, ip)
+			}
+		}
+		if len(l.buckets) > 0 {
+			p.schedulePruning()
+		}
+	})
+}
+
+func (l *sessionLimits) String() string {
+	return fmt.Sprintf("sessions %d\nsources %d\nusers %d\n"+
+		"rejected_max_sessions %d\nrejected_per_ip %d\nrejected_per_user %d\nrejected_rate %d\n",
+		l.total, len(l.perIP), len(l.perUser), l.rejectedTotal, l.rejectedIP, l.rejectedUser, l.rejectedRate)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = map[string]logLevel{
+	"debug": levelDebug,
+	"info":  levelInfo,
+	"warn":  levelWarn,
+	"error": levelError,
+}
+
+func init() {
+	setLogLevel(levelInfo)
+}
+
+// currentLogLevel drops messages below it. It is atomic since goroutines
+// outside the event loop log as well.
+var currentLogLevel atomic.Int32
+
+func setLogLevel(level logLevel) {
+	currentLogLevel.Store(int32(level))
+}
+
+func parseLogLevel(name string) (logLevel, error) {
+	level, ok := logLevelNames[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown log level %q, expected debug, info, warn or error", name)
+	}
+	return level, nil
+}
+
+func logf(level logLevel, format string, args ...any) {
+	if int32(level) >= currentLogLevel.Load() {
+		log.Printf(format, args...)
+	}
+}
+
+// debugf is for per-query and per-attempt details.
+func debugf(format string, args ...any) { logf(levelDebug, format, args...) }
+
+// infof is for session lifecycle events.
+func infof(format string, args ...any) { logf(levelInfo, format, args...) }
+
+// warnf is for failed requests and denials.
+func warnf(format string, args ...any) { logf(levelWarn, format, args...) }
+
+// errorf is for problems of the proxy itself rather than of a single session.
+func errorf(format string, args ...any) { logf(levelError, format, args...) }
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Histogram buckets in seconds.
+var (
+	latencyBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	loopBuckets    = []float64{.00001, .00005, .0001, .0005, .001, .005, .01, .05, .1}
+)
+
+// Label values of the labeled counters.
+var (
+	rejectReasons  = []string{"rate", "max_sessions", "per_ip", "per_user", "quota", "auth", "acl"}
+	failedStages   = []string{"auth", "login", "request", "connecting", "bind_wait"}
+	dnsOutcomes    = []string{"success", "nxdomain", "cached", "timeout", "failure"}
+	directionNames = []string{"upload", "download"}
+)
+
+// proxyMetrics is updated by the event loop and read by the metrics server,
+// so everything in it is atomic.
+type proxyMetrics struct {
+	accepted        atomic.Uint64
+	rejected        counterVec
+	handshakeFailed counterVec
+	dnsQueries      counterVec
+	dnsDuration     histogram
+	connectDuration histogram
+	bytesRelayed    counterVec
+	sessions        atomic.Int64
+	loopIteration   histogram
+}
+
+var metrics = proxyMetrics{
+	rejected:        newCounterVec(rejectReasons),
+	handshakeFailed: newCounterVec(failedStages),
+	dnsQueries:      newCounterVec(dnsOutcomes),
+	dnsDuration:     newHistogram(latencyBuckets),
+	connectDuration: newHistogram(latencyBuckets),
+	bytesRelayed:    newCounterVec(directionNames),
+	loopIteration:   newHistogram(loopBuckets),
+}
+
+// counterVec is a counter per value of a fixed set of label values.
+type counterVec struct {
+	values []string
+	counts []atomic.Uint64
+}
+
+func newCounterVec(values []string) counterVec {
+	return counterVec{values: values, counts: make([]atomic.Uint64, len(values))}
+}
+
+func (v *counterVec) add(value string, n uint64) {
+	for i, name := range v.values {
+		if name == value {
+			v.counts[i].Add(n)
+			return
+		}
+	}
+}
+
+// histogram counts observations in cumulative buckets like Prometheus does.
+type histogram struct {
+	bounds []float64
+	// One count per bound plus +Inf, not cumulative until written.
+	counts []atomic.Uint64
+	sum    atomic.Uint64 // float64 bits
+}
+
+func newHistogram(bounds []float64) histogram {
+	return histogram{bounds: bounds, counts: make([]atomic.Uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	v := d.Seconds()
+	i := 0
+	for i < len(h.bounds) && v > h.bounds[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	for {
+		old := h.sum.Load()
+		if h.sum.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func (m *proxyMetrics) write(w io.Writer) {
+	header := func(name, kind, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+	vec := func(name, label, help string, v *counterVec) {
+		header(name, "counter", help)
+		for i, value := range v.values {
+			fmt.Fprintf(w, "%s{%s=%q} %d\n", name, label, value, v.counts[i].Load())
+		}
+	}
+	hist := func(name, help string, h *histogram) {
+		header(name, "histogram", help)
+		var total uint64
+		for i, bound := range h.bounds {
+			total += h.counts[i].Load()
+			fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, strconv.FormatFloat(bound, 'g', -1, 64), total)
+		}
+		total += h.counts[len(h.bounds)].Load()
+		fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, total)
+		fmt.Fprintf(w, "%s_sum %g\n%s_count %d\n", name, math.Float64frombits(h.sum.Load()), name, total)
+	}
+
+	header("lab5_connections_accepted_total", "counter", "Client connections accepted.")
+	fmt.Fprintf(w, "lab5_connections_accepted_total %d\n", m.accepted.Load())
+	vec("lab5_connections_rejected_total", "reason", "Client connections and requests refused by limits, quotas, authentication or the ACL.", &m.rejected)
+	vec("lab5_handshake_failures_total", "stage", "Sessions closed before relaying, by the stage they were in.", &m.handshakeFailed)
+	vec("lab5_dns_queries_total", "outcome", "DNS lookups by outcome.", &m.dnsQueries)
+	hist("lab5_dns_query_duration_seconds", "Time from sending a DNS query to its final answer.", &m.dnsDuration)
+	hist("lab5_connect_duration_seconds", "Time from the first connect attempt to an established connection.", &m.connectDuration)
+	vec("lab5_relayed_bytes_total", "direction", "Bytes relayed from clients (upload) and to clients (download).", &m.bytesRelayed)
+	header("lab5_sessions_active", "gauge", "Sessions currently open.")
+	fmt.Fprintf(w, "lab5_sessions_active %d\n", m.sessions.Load())
+	hist("lab5_loop_iteration_seconds", "Time the event loop spends handling the events of one wakeup.", &m.loopIteration)
+}
+
+// serveMetrics serves the metrics in the Prometheus text format at /metrics on addr.
+func (p *Proxy) serveMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		metrics.write(w)
+	})
+	server, err := serveHTTP(addr, mux)
+	if err != nil {
+		return err
+	}
+	p.metricsAddr = addr
+	p.metricsServer = server
+	return nil
+}
+
+func (p *Proxy) closeMetrics() {
+	if p.metricsServer != nil {
+		p.metricsServer.Close()
+	}
+}
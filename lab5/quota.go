@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Usage is written back to the quota file at most this often.
+const quotaSaveInterval = 30 * time.Second
+
+var errQuotaExceeded = errors.New("traffic quota exceeded")
+
+// quotaUsage counts the bytes a user relayed in both directions during the
+// current day and month, in local time.
+type quotaUsage struct {
+	Day     string `json:"day"`
+	Daily   int64  `json:"daily"`
+	Month   string `json:"month"`
+	Monthly int64  `json:"monthly"`
+}
+
+// roll starts new periods once the day or month changed.
+func (u *quotaUsage) roll(now time.Time) {
+	if day := now.Format(time.DateOnly); u.Day != day {
+		u.Day, u.Daily = day, 0
+	}
+	if month := now.Format("2006-01"); u.Month != month {
+		u.Month, u.Monthly = month, 0
+	}
+}
+
+// quotaStore keeps the usage of every user, persisted as JSON if path is set.
+type quotaStore struct {
+	path      string
+	users     map[string]*quotaUsage
+	dirty     bool
+	saveTimer *timer
+}
+
+func loadQuotaStore(path string) (*quotaStore, error) {
+	q := &quotaStore{path: path, users: make(map[string]*quotaUsage)}
+	if path == "" {
+		return q, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &q.users); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return q, nil
+}
+
+// save writes the usage to a temporary file and renames it over the old one,
+// so a crash never leaves a truncated file behind.
+func (q *quotaStore) save() error {
+	if q.path == "" || !q.dirty {
+		return nil
+	}
+	data, err := json.MarshalIndent(q.users, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(q.path), filepath.Base(q.path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), q.path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	q.dirty = false
+	return nil
+}
+
+func (q *quotaStore) usage(user string, now time.Time) *quotaUsage {
+	u, ok := q.users[user]
+	if !ok {
+		u = &quotaUsage{}
+		q.users[user] = u
+	}
+	u.roll(now)
+	return u
+}
+
+// quotaLimits returns the daily and monthly quota of user, zero means unlimited.
+func (p *Proxy) quotaLimits(user string) (daily, monthly int64) {
+	cfg := p.cfg.Quotas
+	daily, monthly = cfg.Daily, cfg.Monthly
+	if override, ok := cfg.Users[user]; ok {
+		daily, monthly = override.Daily, override.Monthly
+	}
+	return daily, monthly
+}
+
+func (p *Proxy) checkQuota(user string) error {
+	u := p.quotas.usage(user, time.Now())
+	daily, monthly := p.quotaLimits(user)
+	if daily > 0 && u.Daily >= daily {
+		return fmt.Errorf("%w: user %q relayed %d of %d bytes today", errQuotaExceeded, user, u.Daily, daily)
+	}
+	if monthly > 0 && u.Monthly >= monthly {
+		return fmt.Errorf("%w: user %q relayed %d of %d bytes this month", errQuotaExceeded, user, u.Monthly, monthly)
+	}
+	return nil
+}
+
+// countTraffic adds n relayed bytes to the user of client and cuts the sessions
+// of that user if configured once the quota is used up.
+func (p *Proxy) countTraffic(client *ClientConn, n int) {
+	if n == 0 || client.user == "" {
+		return
+	}
+	u := p.quotas.usage(client.user, time.Now())
+	u.Daily += int64(n)
+	u.Monthly += int64(n)
+	p.scheduleQuotaSave()
+
+	if !p.cfg.Quotas.CutSessions || client.quotaCut {
+		return
+	}
+	if err := p.checkQuota(client.user); err != nil {
+		// Not closed right here, the caller is still using client.
+		user := client.user
+		p.timers.after(0, func() { p.closeUserSessions(user, err) })
+		client.quotaCut = true
+	}
+}
+
+// closeUserSessions closes every session of user and returns how many there were.
+func (p *Proxy) closeUserSessions(user string, reason error) int {
+	closed := 0
+	for fd, client := range p.conns {
+		if fd == client.clientFd && client.user == user {
+			warnf("Client %d%s closed: %v", client.clientFd, client.userTag(), reason)
+			client.noteClose(reason.Error())
+			p.closeClient(fd)
+			closed++
+		}
+	}
+	return closed
+}
+
+func (p *Proxy) scheduleQuotaSave() {
+	q := p.quotas
+	q.dirty = true
+	if q.path == "" || q.saveTimer != nil {
+		return
+	}
+	q.saveTimer = p.timers.after(quotaSaveInterval, func() {
+		q.saveTimer = nil
+		if err := q.save(); err != nil {
+			errorf("Saving quota usage failed: %v", err)
+		}
+	})
+}
+
+// saveQuotas writes pending usage, e.g. before the proxy exits.
+func (p *Proxy) saveQuotas() {
+	p.timers.stop(p.quotas.saveTimer)
+	p.quotas.saveTimer = nil
+	if err := p.quotas.save(); err != nil {
+		errorf("Saving quota usage failed: %v", err)
+	}
+}
+
+// quotaReport lists the usage of user, or of every user if it is empty.
+func (p *Proxy) quotaReport(user string) string {
+	now := time.Now()
+	var users []string
+	if user != "" {
+		users = []string{user}
+	} else {
+		for name := range p.quotas.users {
+			users = append(users, name)
+		}
+		sort.Strings(users)
+	}
+
+	var b strings.Builder
+	for _, name := range users {
+		// Unknown users are listed without being added.
+		u := &quotaUsage{}
+		if _, ok := p.quotas.users[name]; ok {
+			u = p.quotas.usage(name, now)
+		}
+		daily, monthly := p.quotaLimits(name)
+		fmt.Fprintf(&b, "%s daily %d/%d monthly %d/%d\n", name, u.Daily, daily, u.Monthly, monthly)
+	}
+	return b.String()
+}
+
+// resetQuota clears the usage of user, or of every user for "all".
+func (p *Proxy) resetQuota(user string) {
+	if user == "all" {
+		clear(p.quotas.users)
+	} else {
+		delete(p.quotas.users, user)
+	}
+	for fd, client := range p.conns {
+		if fd == client.clientFd && (user == "all" || client.user == user) {
+			client.quotaCut = false
+		}
+	}
+	p.scheduleQuotaSave()
+	infof("Quota usage reset for %s", user)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"errors"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// errSessionDone is returned once both directions of a session are finished.
+var errSessionDone = errors.New("session finished")
+
+// ipToSockaddr returns the address family and sockaddr for connecting to ip:port.
+func ipToSockaddr(ip net.IP, port int) (int, unix.Sockaddr) {
+	if ip4 := ip.To4(); ip4 != nil {
+		sa := &unix.SockaddrInet4{Port: port}
+		copy(sa.Addr[:], ip4)
+		return unix.AF_INET, sa
+	}
+	sa := &unix.SockaddrInet6{Port: port}
+	copy(sa.Addr[:], ip.To16())
+	return unix.AF_INET6, sa
+}
+
+// startRelay switches the session to relaying and forwards data the client sent early.
+func (p *Proxy) startRelay(client *ClientConn) error {
+	// Only connections the client asked for have a server name to look for.
+	asked := client.stage == connecting
+	client.stage = establish
+	p.armIdleTimeout(client)
+	p.startShaping(client)
+
+	if len(client.buffer) > 0 {
+		client.toRemote = append(client.toRemote, client.buffer...)
+		client.buffer = nil
+	}
+	if asked {
+		p.startSniff(client)
+	}
+	if err := p.sniff(client); err != nil {
+		return err
+	}
+	p.maybeCapture(client)
+	if !client.holding {
+		if err := flushTo(client.remoteFd, &client.toRemote); err != nil {
+			return err
+		}
+	}
+
+	return p.updateInterest(client)
+}
+
+// attachRemote makes the connected socket remoteFd the remote side of the client
+// session. The session owns remoteFd from now on, also if attaching fails.
+func (p *Proxy) attachRemote(client *ClientConn, remoteFd int) error {
+	if err := unix.EpollCtl(p.epollFd, unix.EPOLL_CTL_ADD, remoteFd, &unix.EpollEvent{
+		Events: unix.EPOLLIN,
+		Fd:     int32(remoteFd),
+	}); err != nil {
+		unix.Close(remoteFd)
+		return err
+	}
+
+	client.remoteFd = remoteFd
+	client.remoteEvents = unix.EPOLLIN
+	p.conns[remoteFd] = client
+	return nil
+}
+
+func (p *Proxy) handleRemoteEvent(client *ClientConn, events uint32) error {
+	if events&(unix.EPOLLIN|unix.EPOLLHUP) != 0 && !client.remoteEOF {
+		eof, err := p.shapedRead(client, dirDownload, client.remoteFd, &client.toClient)
+		if err != nil {
+			return err
+		}
+		client.remoteEOF = eof
+		if err := flushTo(client.clientFd, &client.toClient); err != nil {
+			return err
+		}
+		if err := p.parkHungUp(client, dirDownload, events); err != nil {
+			return err
+		}
+	}
+
+	if events&unix.EPOLLOUT != 0 && !client.holding {
+		if err := flushTo(client.remoteFd, &client.toRemote); err != nil {
+			return err
+		}
+	}
+
+	if events&unix.EPOLLERR != 0 {
+		return errors.New("remote connection error")
+	}
+	if events&unix.EPOLLHUP != 0 && client.remoteEOF {
+		return errSessionDone
+	}
+
+	return p.finishIO(client)
+}
+
+// relayFromClient moves client data towards the remote once the session is established.
+func (p *Proxy) relayFromClient(client *ClientConn) error {
+	if client.clientEOF {
+		return nil
+	}
+
+	eof, err := p.shapedRead(client, dirUpload, client.clientFd, &client.toRemote)
+	if err != nil {
+		return err
+	}
+	client.clientEOF = eof
+
+	if err := p.sniff(client); err != nil || client.holding {
+		return err
+	}
+	return flushTo(client.remoteFd, &client.toRemote)
+}
+
+// finishIO propagates half-closes, detects the end of the session and refreshes epoll interest.
+func (p *Proxy) finishIO(client *ClientConn) error {
+	if client.stage != establish {
+		return p.updateInterest(client)
+	}
+
+	if client.clientEOF && len(client.toRemote) == 0 && !client.remoteShut {
+		unix.Shutdown(client.remoteFd, unix.SHUT_WR)
+		client.remoteShut = true
+	}
+	if client.remoteEOF && len(client.toClient) == 0 && !client.clientShut {
+		unix.Shutdown(client.clientFd, unix.SHUT_WR)
+		client.clientShut = true
+	}
+	if client.remoteShut && client.clientShut {
+		return errSessionDone
+	}
+
+	return p.updateInterest(client)
+}
+
+// readInto reads up to limit bytes from fd until it would block, hits EOF or out is full.
+func (p *Proxy) readInto(fd int, out *[]byte, limit int) (total int, eof bool, err error) {
+	for len(*out) < p.bufferSize && total < limit {
+		n, err := unix.Read(fd, p.relayBuf[:min(p.bufferSize-len(*out), limit-total)])
+		if err != nil {
+			if errors.Is(err, unix.EAGAIN) {
+				return total, false, nil
+			}
+			return total, false, err
+		}
+		if n == 0 {
+			return total, true, nil
+		}
+		*out = append(*out, p.relayBuf[:n]...)
+		total += n
+	}
+	return total, false, nil
+}
+
+// flushTo writes as much of out to fd as the socket accepts and keeps the rest.
+func flushTo(fd int, out *[]byte) error {
+	written := 0
+	for written < len(*out) {
+		n, err := unix.Write(fd, (*out)[written:])
+		if err != nil {
+			if errors.Is(err, unix.EAGAIN) {
+				break
+			}
+			return err
+		}
+		written += n
+	}
+
+	rest := copy(*out, (*out)[written:])
+	*out = (*out)[:rest]
+	return nil
+}
+
+// sendToClient queues a protocol message for the client and tries to flush it immediately.
+func (p *Proxy) sendToClient(client *ClientConn, msg []byte) error {
+	client.toClient = append(client.toClient, msg...)
+	if err := flushTo(client.clientFd, &client.toClient); err != nil {
+		return err
+	}
+	return p.updateInterest(client)
+}
+
+// updateInterest registers the events each side of the session currently waits for.
+func (p *Proxy) updateInterest(client *ClientConn) error {
+	var clientEvents uint32
+	switch {
+	case client.paused():
+		// Do not read more for now, just notice the client leaving.
+		if !client.clientRDHUP {
+			clientEvents = unix.EPOLLRDHUP
+		}
+	case client.stage == establish:
+		if !client.clientEOF && len(client.toRemote) < p.bufferSize && !client.throttled[dirUpload] {
+			clientEvents |= unix.EPOLLIN
+		}
+	default:
+		clientEvents = unix.EPOLLIN
+	}
+	if len(client.toClient) > 0 {
+		clientEvents |= unix.EPOLLOUT
+	}
+
+	if clientEvents != client.clientEvents && !client.parked[dirUpload] {
+		if err := unix.EpollCtl(p.epollFd, unix.EPOLL_CTL_MOD, client.clientFd, &unix.EpollEvent{
+			Events: clientEvents,
+			Fd:     int32(client.clientFd),
+		}); err != nil {
+			return err
+		}
+		client.clientEvents = clientEvents
+	}
+
+	if client.remoteFd == 0 {
+		return nil
+	}
+
+	var remoteEvents uint32
+	if client.stage == establish {
+		if !client.remoteEOF && len(client.toClient) < p.bufferSize && !client.throttled[dirDownload] {
+			remoteEvents |= unix.EPOLLIN
+		}
+		if len(client.toRemote) > 0 && !client.holding {
+			remoteEvents |= unix.EPOLLOUT
+		}
+	} else if hs := client.upstreamState; hs != nil {
+		remoteEvents = unix.EPOLLIN
+		if len(hs.out) > 0 {
+			remoteEvents |= unix.EPOLLOUT
+		}
+	}
+
+	if remoteEvents != client.remoteEvents && !client.parked[dirDownload] {
+		if err := unix.EpollCtl(p.epollFd, unix.EPOLL_CTL_MOD, client.remoteFd, &unix.EpollEvent{
+			Events: remoteEvents,
+			Fd:     int32(client.remoteFd),
+		}); err != nil {
+			return err
+		}
+		client.remoteEvents = remoteEvents
+	}
+
+	return nil
+}
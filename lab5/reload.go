@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// settings is a validated configuration with its files loaded, ready to be applied.
+type settings struct {
+	cfg         *Config
+	creds       *Credentials
+	acl         *ACL
+	quotas      *quotaStore
+	accessLog   *accessLog
+	capture     []*aclRule
+	routes      []upstreamRoute
+	servers     []string
+	dnsTimeout  time.Duration
+	dnsAttempts int
+}
+
+// loadSettings reads everything cfg refers to. It does no I/O on the proxy itself,
+// so a reload can run it outside the event loop.
+func loadSettings(cfg *Config) (*settings, error) {
+	s := &settings{
+		cfg:         cfg,
+		servers:     cfg.DNS.Servers,
+		dnsTimeout:  cfg.DNS.Timeout,
+		dnsAttempts: cfg.DNS.Attempts,
+	}
+
+	if len(s.servers) == 0 {
+		servers, timeout, attempts, err := LoadResolvConf("/etc/resolv.conf")
+		if err != nil || len(servers) == 0 {
+			warnf("No usable /etc/resolv.conf, falling back to 8.8.8.8: %v", err)
+			servers = []string{"8.8.8.8:53"}
+		}
+		s.servers = servers
+		if s.dnsTimeout == 0 {
+			s.dnsTimeout = timeout
+		}
+		if s.dnsAttempts == 0 {
+			s.dnsAttempts = attempts
+		}
+	}
+
+	var err error
+	if cfg.Policy.Credentials != "" {
+		if s.creds, err = LoadCredentials(cfg.Policy.Credentials); err != nil {
+			return nil, fmt.Errorf("loading credentials: %w", err)
+		}
+	}
+	if cfg.Policy.ACL != "" {
+		if s.acl, err = LoadACL(cfg.Policy.ACL); err != nil {
+			return nil, fmt.Errorf("loading ACL: %w", err)
+		}
+	}
+	if s.quotas, err = loadQuotaStore(cfg.Quotas.File); err != nil {
+		return nil, fmt.Errorf("loading quota usage: %w", err)
+	}
+	if s.capture, err = parseCaptureRules(cfg.Capture.Rules); err != nil {
+		return nil, err
+	}
+	if s.routes, err = parseRoutes(cfg); err != nil {
+		return nil, err
+	}
+	if cfg.AccessLog.File != "" {
+		if s.accessLog, err = openAccessLog(cfg.AccessLog.File); err != nil {
+			return nil, fmt.Errorf("opening access log: %w", err)
+		}
+	}
+	return s, nil
+}
+
+// applySettings switches the policy used for new sessions. Established sessions
+// already passed authentication and the rules and are not checked again.
+func (p *Proxy) applySettings(s *settings) {
+	p.cfg = s.cfg
+	p.creds = s.creds
+	p.acl = s.acl
+	p.preferIPv4 = s.cfg.DNS.PreferIPv4
+	// The counters in memory are newer than the file unless it changed.
+	if p.quotas == nil || p.quotas.path != s.quotas.path {
+		if p.quotas != nil {
+			p.saveQuotas()
+		}
+		p.quotas = s.quotas
+	}
+	p.setAccessLog(s.accessLog, s.cfg)
+	p.captureRules = s.capture
+	p.holdForName = usesNames(s.capture) || s.acl != nil && usesNames(s.acl.rules)
+	p.routes = s.routes
+	level, _ := parseLogLevel(s.cfg.Log.Level)
+	setLogLevel(level)
+
+	if s.cfg.Buffers.Relay != p.bufferSize {
+		p.bufferSize = s.cfg.Buffers.Relay
+		p.relayBuf = make([]byte, p.bufferSize)
+	}
+}
+
+// Reload re-reads the configuration with the arguments the proxy was started with
+// and applies it. Nothing changes if any part of it is invalid. Safe to call from
+// any goroutine except the event loop.
+func (p *Proxy) Reload() error {
+	cfg, _, err := LoadConfig(p.args)
+	if err != nil {
+		return err
+	}
+	s, err := loadSettings(cfg)
+	if err != nil {
+		return err
+	}
+	if cfg.Control != p.controlPath {
+		warnf("Control socket changes need a restart, still using %q", p.controlPath)
+	}
+	if cfg.Metrics != p.metricsAddr {
+		warnf("Metrics address changes need a restart, still using %q", p.metricsAddr)
+	}
+	if cfg.Admin != p.adminAddr {
+		warnf("Admin address changes need a restart, still using %q", p.adminAddr)
+	}
+
+	err = p.call(func() error {
+		if p.shutdown != nil {
+			return errShuttingDown
+		}
+		opened, err := p.openListeners(cfg.Listen)
+		if err != nil {
+			return err
+		}
+		if err := p.resolver.reconfigure(s.servers, s.dnsTimeout, s.dnsAttempts, cfg.DNS.CacheSize); err != nil {
+			for _, fd := range opened {
+				p.closeListener(fd)
+			}
+			return err
+		}
+		closed := p.closeListenersExcept(cfg.Listen)
+		p.applySettings(s)
+
+		infof("Configuration reloaded: %d listeners opened, %d closed, %d sessions kept",
+			len(opened), closed, p.sessionCount())
+		return nil
+	})
+	if err != nil {
+		// Nothing was applied, the access log opened for it is not used.
+		s.accessLog.close()
+	}
+	return err
+}
+
+// openListeners starts listening on the addresses of listen not listened on yet.
+// Either all of them are opened or none.
+func (p *Proxy) openListeners(listen []string) ([]int, error) {
+	var opened []int
+	for _, addr := range listen {
+		if _, ok := p.listenAddrs[addr]; ok {
+			continue
+		}
+		fd, err := p.listen(addr)
+		if err == nil {
+			err = p.registerListener(fd)
+		}
+		if err != nil {
+			for _, fd := range opened {
+				p.closeListener(fd)
+			}
+			return nil, err
+		}
+		opened = append(opened, fd)
+	}
+	return opened, nil
+}
+
+func (p *Proxy) closeListenersExcept(listen []string) int {
+	keep := make(map[string]bool)
+	for _, addr := range listen {
+		keep[addr] = true
+	}
+
+	closed := 0
+	for addr, fd := range p.listenAddrs {
+		if !keep[addr] {
+			infof("Proxy no longer listening on %s", addr)
+			p.closeListener(fd)
+			closed++
+		}
+	}
+	return closed
+}
+
+// sessionCount returns the number of client connections, whatever their stage.
+func (p *Proxy) sessionCount() int {
+	n := 0
+	for fd, client := range p.conns {
+		if fd == client.clientFd {
+			n++
+		}
+	}
+	return n
+}
+
+// watchSignals reloads the configuration on SIGHUP and shuts down on SIGTERM or SIGINT,
+// a second one of those skips draining.
+func (p *Proxy) watchSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		for sig := range signals {
+			if sig != syscall.SIGHUP {
+				infof("%s received, shutting down", sig)
+				p.Shutdown()
+				continue
+			}
+			infof("SIGHUP received, reloading configuration")
+			if err := p.Reload(); err != nil {
+				errorf("Reload failed, keeping the current configuration: %v", err)
+			}
+		}
+	}()
+}
+
+// serveControl accepts commands on the control socket, one command line per connection.
+func (p *Proxy) serveControl(path string) error {
+	// A socket file left over by a previous run would make Listen fail.
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	p.controlPath = path
+	p.control = ln
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					errorf("Control accept error: %v", err)
+				}
+				return
+			}
+			go p.handleControl(conn)
+		}
+	}()
+	return nil
+}
+
+func (p *Proxy) closeControl() {
+	if p.control != nil {
+		p.control.Close()
+	}
+}
+
+func (p *Proxy) handleControl(conn net.Conn) {
+	defer conn.Close()
+
+	line, err := bufio.NewReader(io.LimitReader(conn, 4096)).ReadString('\n')
+	if err != nil && line == "" {
+		return
+	}
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		return
+	}
+
+	reply, err := p.controlCommand(args)
+	if err != nil {
+		fmt.Fprintf(conn, "error: %v\n", err)
+		return
+	}
+	fmt.Fprintf(conn, "ok\n%s", reply)
+}
+
+// controlCommand runs one command of the control socket and returns its output.
+func (p *Proxy) controlCommand(args []string) (string, error) {
+	infof("Control command: %s", strings.Join(args, " "))
+	switch args[0] {
+	case "reload":
+		return "", p.Reload()
+	case "stats":
+		var stats string
+		err := p.call(func() error {
+			stats = p.limits.String()
+			return nil
+		})
+		return stats, err
+	case "shutdown":
+		return "", p.Shutdown()
+	case "quota":
+		var user, report string
+		if len(args) > 1 {
+			user = args[1]
+		}
+		err := p.call(func() error {
+			report = p.quotaReport(user)
+			return nil
+		})
+		return report, err
+	case "quota-reset":
+		if len(args) != 2 {
+			return "", errors.New("usage: quota-reset USER|all")
+		}
+		return "", p.call(func() error {
+			p.resetQuota(args[1])
+			return nil
+		})
+	default:
+		return "", fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+// runControlCommand sends a command to a running proxy and prints its answer,
+// returning the process exit code.
+func runControlCommand(path string, args []string) int {
+	if path == "" {
+		fmt.Fprintln(os.Stderr, "no control socket configured")
+		return 2
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer conn.Close()
+
+	if _, err := fmt.Fprintln(conn, strings.Join(args, " ")); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	reply, err := io.ReadAll(conn)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	os.Stdout.Write(reply)
+	if !strings.HasPrefix(string(reply), "ok\n") {
+		return 1
+	}
+	return 0
+}
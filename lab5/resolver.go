@@ -0,0 +1,581 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	dnsDefaultTimeout  = 2 * time.Second
+	dnsDefaultAttempts = 2
+	// Advertised EDNS0 UDP payload size, small enough to avoid IP fragmentation.
+	ednsBufferSize = 1232
+)
+
+var (
+	errDNSTimeout = errors.New("DNS query timed out")
+	errDNSFailure = errors.New("DNS query failed")
+)
+
+type dnsUpstream struct {
+	addr *net.UDPAddr
+	fd   int
+}
+
+type dnsQuery struct {
+	id       uint16
+	key      dnsKey
+	name     string
+	qtype    uint16
+	packed   []byte
+	attempt  int
+	deadline time.Time
+	started  time.Time
+	// Every lookup of the same name and type waiting for this query.
+	waiters []func(*dns.Msg, error)
+
+	// TCP fallback state after a truncated UDP answer.
+	tcpFd  int
+	tcpOut []byte
+	tcpIn  []byte
+}
+
+// Resolver performs asynchronous DNS lookups from within the epoll loop.
+// Each attempt waits timeout for an answer, attempts rounds go through all upstreams.
+type Resolver struct {
+	upstreams []*dnsUpstream
+	timeout   time.Duration
+	attempts  int
+	epollFd   int
+	pending   map[uint16]*dnsQuery
+	inflight  map[dnsKey]*dnsQuery
+	tcpConns  map[int]*dnsQuery
+	cache     *dnsCache
+	// Callbacks of cache hits, run on the next loop iteration.
+	deferred []func()
+	buf      []byte
+}
+
+// LoadResolvConf returns the name servers and options of a resolv.conf file.
+func LoadResolvConf(path string) (servers []string, timeout time.Duration, attempts int, err error) {
+	conf, err := dns.ClientConfigFromFile(path)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	for _, server := range conf.Servers {
+		servers = append(servers, net.JoinHostPort(server, conf.Port))
+	}
+	return servers, time.Duration(conf.Timeout) * time.Second, conf.Attempts, nil
+}
+
+// NewResolver creates a resolver for the given "ip[:port]" upstreams.
+// Up to cacheSize answers are cached, zero disables the cache.
+func NewResolver(servers []string, timeout time.Duration, attempts int, cacheSize int) (*Resolver, error) {
+	if len(servers) == 0 {
+		return nil, errors.New("no DNS upstreams configured")
+	}
+	if timeout <= 0 {
+		timeout = dnsDefaultTimeout
+	}
+	if attempts <= 0 {
+		attempts = dnsDefaultAttempts
+	}
+
+	r := &Resolver{
+		timeout:  timeout,
+		attempts: attempts,
+		pending:  make(map[uint16]*dnsQuery),
+		inflight: make(map[dnsKey]*dnsQuery),
+		tcpConns: make(map[int]*dnsQuery),
+		cache:    newDNSCache(cacheSize),
+		buf:      make([]byte, 65535),
+	}
+
+	upstreams, err := dialUpstreams(servers)
+	if err != nil {
+		return nil, err
+	}
+	r.upstreams = upstreams
+
+	return r, nil
+}
+
+// dialUpstreams opens a connected non-blocking UDP socket per upstream.
+func dialUpstreams(servers []string) ([]*dnsUpstream, error) {
+	var upstreams []*dnsUpstream
+	for _, server := range servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		addr, err := net.ResolveUDPAddr("udp", server)
+		if err != nil {
+			closeUpstreams(upstreams)
+			return nil, fmt.Errorf("DNS upstream %s: %w", server, err)
+		}
+
+		family, sa := ipToSockaddr(addr.IP, addr.Port)
+		fd, err := unix.Socket(family, unix.SOCK_DGRAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+		if err != nil {
+			closeUpstreams(upstreams)
+			return nil, err
+		}
+		if err := unix.Connect(fd, sa); err != nil {
+			unix.Close(fd)
+			closeUpstreams(upstreams)
+			return nil, fmt.Errorf("DNS upstream %s: %w", server, err)
+		}
+
+		upstreams = append(upstreams, &dnsUpstream{addr: addr, fd: fd})
+	}
+	return upstreams, nil
+}
+
+func closeUpstreams(upstreams []*dnsUpstream) {
+	for _, upstream := range upstreams {
+		unix.Close(upstream.fd)
+	}
+}
+
+// reconfigure switches to new upstreams and limits. Queries waiting for an answer
+// from a replaced upstream are retried on the new ones once their attempt times out.
+// The cache is kept unless its size changes.
+func (r *Resolver) reconfigure(servers []string, timeout time.Duration, attempts int, cacheSize int) error {
+	if len(servers) == 0 {
+		return errors.New("no DNS upstreams configured")
+	}
+	upstreams, err := dialUpstreams(servers)
+	if err != nil {
+		return err
+	}
+	for _, upstream := range upstreams {
+		if err := unix.EpollCtl(r.epollFd, unix.EPOLL_CTL_ADD, upstream.fd, &unix.EpollEvent{
+			Events: unix.EPOLLIN,
+			Fd:     int32(upstream.fd),
+		}); err != nil {
+			closeUpstreams(upstreams)
+			return err
+		}
+	}
+
+	closeUpstreams(r.upstreams)
+	r.upstreams = upstreams
+
+	if timeout <= 0 {
+		timeout = dnsDefaultTimeout
+	}
+	if attempts <= 0 {
+		attempts = dnsDefaultAttempts
+	}
+	r.timeout = timeout
+	r.attempts = attempts
+	if cacheSize != r.cache.size {
+		r.cache = newDNSCache(cacheSize)
+	}
+	return nil
+}
+
+func (r *Resolver) register(epollFd int) error {
+	r.epollFd = epollFd
+	for _, upstream := range r.upstreams {
+		if err := unix.EpollCtl(epollFd, unix.EPOLL_CTL_ADD, upstream.fd, &unix.EpollEvent{
+			Events: unix.EPOLLIN,
+			Fd:     int32(upstream.fd),
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Resolver) close() {
+	hits, misses, entries := r.cache.stats()
+	infof("DNS cache: %d hits, %d misses, %d entries", hits, misses, entries)
+
+	for _, q := range r.pending {
+		r.closeTCP(q)
+	}
+	closeUpstreams(r.upstreams)
+}
+
+func (r *Resolver) owns(fd int) bool {
+	if _, ok := r.tcpConns[fd]; ok {
+		return true
+	}
+	for _, upstream := range r.upstreams {
+		if upstream.fd == fd {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup resolves name from the cache or by joining or starting a query.
+// done is always called later from the event loop, with either a response
+// (NOERROR or NXDOMAIN) or an error.
+func (r *Resolver) lookup(name string, qtype uint16, done func(*dns.Msg, error)) error {
+	key := newDNSKey(name, qtype)
+
+	if msg, ok := r.cache.get(key, time.Now()); ok {
+		debugf("DNS cache hit for %s %s", name, dns.TypeToString[qtype])
+		metrics.dnsQueries.add("cached", 1)
+		r.deferred = append(r.deferred, func() { done(msg, nil) })
+		return nil
+	}
+
+	if q, ok := r.inflight[key]; ok {
+		q.waiters = append(q.waiters, done)
+		return nil
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), qtype)
+	msg.RecursionDesired = true
+	msg.SetEdns0(ednsBufferSize, false)
+
+	msg.Id = r.newID()
+	packed, err := msg.Pack()
+	if err != nil {
+		return err
+	}
+
+	q := &dnsQuery{
+		id:      msg.Id,
+		key:     key,
+		name:    msg.Question[0].Name,
+		qtype:   qtype,
+		packed:  packed,
+		started: time.Now(),
+		waiters: []func(*dns.Msg, error){done},
+	}
+	r.pending[q.id] = q
+	r.inflight[key] = q
+	r.send(q)
+
+	debugf("DNS query sent for %s %s (ID: %d)", name, dns.TypeToString[qtype], q.id)
+	return nil
+}
+
+// inflightQueries describes the queries waiting for an answer.
+func (r *Resolver) inflightQueries() []dnsQueryInfo {
+	queries := make([]dnsQueryInfo, 0, len(r.inflight))
+	for _, q := range r.inflight {
+		queries = append(queries, dnsQueryInfo{
+			Name:     strings.TrimSuffix(q.name, "."),
+			Type:     dns.TypeToString[q.qtype],
+			Started:  q.started,
+			Attempt:  q.attempt + 1,
+			Upstream: r.upstream(q).addr.String(),
+			TCP:      q.tcpFd != 0,
+			Waiters:  len(q.waiters),
+		})
+	}
+	return queries
+}
+
+// newID picks a random ID not used by any query in flight.
+func (r *Resolver) newID() uint16 {
+	for {
+		id := uint16(rand.Uint32())
+		if _, used := r.pending[id]; !used {
+			return id
+		}
+	}
+}
+
+func (r *Resolver) upstream(q *dnsQuery) *dnsUpstream {
+	return r.upstreams[q.attempt%len(r.upstreams)]
+}
+
+func (r *Resolver) send(q *dnsQuery) {
+	q.deadline = time.Now().Add(r.timeout)
+
+	upstream := r.upstream(q)
+	if _, err := unix.Write(upstream.fd, q.packed); err != nil {
+		warnf("DNS send to %s failed: %v", upstream.addr, err)
+		// Let expire move on to the next attempt.
+		q.deadline = time.Now()
+	}
+}
+
+func (r *Resolver) handleEvent(fd int, events uint32) {
+	if q, ok := r.tcpConns[fd]; ok {
+		if err := r.handleTCP(q, events); err != nil {
+			warnf("DNS TCP query for %s failed: %v", q.name, err)
+			r.retry(q, errDNSFailure)
+		}
+		return
+	}
+
+	for {
+		n, err := unix.Read(fd, r.buf)
+		if err != nil {
+			if errors.Is(err, unix.EAGAIN) {
+				return
+			}
+			// ICMP errors of earlier datagrams show up here on connected sockets.
+			if errors.Is(err, unix.ECONNREFUSED) {
+				continue
+			}
+			errorf("DNS read error: %v", err)
+			return
+		}
+
+		msg := new(dns.Msg)
+		if err := msg.Unpack(r.buf[:n]); err != nil {
+			warnf("DNS malformed response: %v", err)
+			continue
+		}
+
+		q, ok := r.pending[msg.Id]
+		if !ok || q.tcpFd != 0 || !q.matches(msg) {
+			debugf("DNS unexpected response ID: %d", msg.Id)
+			continue
+		}
+
+		if msg.Truncated {
+			r.startTCP(q)
+			continue
+		}
+		r.handleResponse(q, msg)
+	}
+}
+
+func (q *dnsQuery) matches(msg *dns.Msg) bool {
+	if !msg.Response || len(msg.Question) != 1 {
+		return false
+	}
+	question := msg.Question[0]
+	return question.Qtype == q.qtype && strings.EqualFold(question.Name, q.name)
+}
+
+func (r *Resolver) handleResponse(q *dnsQuery, msg *dns.Msg) {
+	switch msg.Rcode {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+		r.finish(q, msg, nil)
+	default:
+		debugf("DNS %s from %s for %s", dns.RcodeToString[msg.Rcode], r.upstream(q).addr, q.name)
+		r.retry(q, errDNSFailure)
+	}
+}
+
+func (r *Resolver) finish(q *dnsQuery, msg *dns.Msg, err error) {
+	delete(r.pending, q.id)
+	delete(r.inflight, q.key)
+	r.closeTCP(q)
+
+	if err == nil {
+		r.cache.put(q.key, msg, time.Now())
+	}
+	metrics.dnsDuration.observe(time.Since(q.started))
+	switch {
+	case err == nil && msg.Rcode == dns.RcodeNameError:
+		metrics.dnsQueries.add("nxdomain", 1)
+	case err == nil:
+		metrics.dnsQueries.add("success", 1)
+	case errors.Is(err, errDNSTimeout):
+		metrics.dnsQueries.add("timeout", 1)
+	default:
+		metrics.dnsQueries.add("failure", 1)
+	}
+	for _, done := range q.waiters {
+		done(msg, err)
+	}
+}
+
+// retry sends q to the next upstream or fails it with cause once attempts are exhausted.
+func (r *Resolver) retry(q *dnsQuery, cause error) {
+	r.closeTCP(q)
+
+	q.attempt++
+	if q.attempt >= r.attempts*len(r.upstreams) {
+		r.finish(q, nil, fmt.Errorf("%w: %s", cause, strings.TrimSuffix(q.name, ".")))
+		return
+	}
+	r.send(q)
+}
+
+// startTCP repeats a query over TCP after a truncated answer.
+func (r *Resolver) startTCP(q *dnsQuery) {
+	upstream := r.upstream(q)
+	family, sa := ipToSockaddr(upstream.addr.IP, upstream.addr.Port)
+
+	fd, err := unix.Socket(family, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		r.retry(q, errDNSFailure)
+		return
+	}
+	if err := unix.Connect(fd, sa); err != nil && !errors.Is(err, unix.EINPROGRESS) {
+		unix.Close(fd)
+		r.retry(q, errDNSFailure)
+		return
+	}
+	if err := unix.EpollCtl(r.epollFd, unix.EPOLL_CTL_ADD, fd, &unix.EpollEvent{
+		Events: unix.EPOLLOUT,
+		Fd:     int32(fd),
+	}); err != nil {
+		unix.Close(fd)
+		r.retry(q, errDNSFailure)
+		return
+	}
+
+	q.tcpFd = fd
+	q.tcpOut = binary.BigEndian.AppendUint16(nil, uint16(len(q.packed)))
+	q.tcpOut = append(q.tcpOut, q.packed...)
+	q.tcpIn = nil
+	q.deadline = time.Now().Add(r.timeout)
+	r.tcpConns[fd] = q
+
+	debugf("DNS response for %s truncated, retrying over TCP", q.name)
+}
+
+func (r *Resolver) handleTCP(q *dnsQuery, events uint32) error {
+	if events&unix.EPOLLERR != 0 {
+		soErr, _ := unix.GetsockoptInt(q.tcpFd, unix.SOL_SOCKET, unix.SO_ERROR)
+		return unix.Errno(soErr)
+	}
+
+	if events&unix.EPOLLOUT != 0 && len(q.tcpOut) > 0 {
+		if err := flushTo(q.tcpFd, &q.tcpOut); err != nil {
+			return err
+		}
+		if len(q.tcpOut) == 0 {
+			if err := unix.EpollCtl(r.epollFd, unix.EPOLL_CTL_MOD, q.tcpFd, &unix.EpollEvent{
+				Events: unix.EPOLLIN,
+				Fd:     int32(q.tcpFd),
+			}); err != nil {
+				return err
+			}
+		}
+	}
+
+	if events&(unix.EPOLLIN|unix.EPOLLHUP) == 0 {
+		return nil
+	}
+
+	for {
+		n, err := unix.Read(q.tcpFd, r.buf)
+		if err != nil {
+			if errors.Is(err, unix.EAGAIN) {
+				return nil
+			}
+			return err
+		}
+		if n == 0 {
+			return errors.New("connection closed before full response")
+		}
+		q.tcpIn = append(q.tcpIn, r.buf[:n]...)
+
+		if len(q.tcpIn) < 2 {
+			continue
+		}
+		size := int(binary.BigEndian.Uint16(q.tcpIn))
+		if len(q.tcpIn) < 2+size {
+			continue
+		}
+
+		msg := new(dns.Msg)
+		if err := msg.Unpack(q.tcpIn[2 : 2+size]); err != nil {
+			return err
+		}
+		if msg.Id != q.id || !q.matches(msg) {
+			return errors.New("mismatched response")
+		}
+		r.closeTCP(q)
+		r.handleResponse(q, msg)
+		return nil
+	}
+}
+
+func (r *Resolver) closeTCP(q *dnsQuery) {
+	if q.tcpFd == 0 {
+		return
+	}
+	delete(r.tcpConns, q.tcpFd)
+	unix.Close(q.tcpFd)
+	q.tcpFd = 0
+}
+
+// nextTimeout returns the EpollWait timeout in milliseconds until the closest deadline, or -1.
+func (r *Resolver) nextTimeout(now time.Time) int {
+	if len(r.deferred) > 0 {
+		return 0
+	}
+
+	timeout := -1
+	for _, q := range r.pending {
+		ms := int(q.deadline.Sub(now).Milliseconds())
+		if ms < 0 {
+			ms = 0
+		}
+		if timeout < 0 || ms < timeout {
+			timeout = ms
+		}
+	}
+	return timeout
+}
+
+// expire delivers cache hits and retries every query whose attempt has run out of time.
+func (r *Resolver) expire(now time.Time) {
+	ready := r.deferred
+	r.deferred = nil
+	for _, done := range ready {
+		done()
+	}
+
+	for _, q := range r.pending {
+		if !now.Before(q.deadline) {
+			r.retry(q, errDNSTimeout)
+		}
+	}
+}
+
+// answerIP returns the first address in a response, see answerIPs.
+func answerIP(name string, msg *dns.Msg) (net.IP, error) {
+	ips, err := answerIPs(name, msg)
+	if err != nil {
+		return nil, err
+	}
+	return ips[0], nil
+}
+
+// answerIPs returns the A and AAAA addresses of a response,
+// or errHostNotFound for NXDOMAIN and empty answers.
+func answerIPs(name string, msg *dns.Msg) ([]net.IP, error) {
+	if msg.Rcode == dns.RcodeNameError {
+		return nil, fmt.Errorf("%w: %s", errHostNotFound, name)
+	}
+
+	var ips []net.IP
+	for _, answer := range msg.Answer {
+		switch rr := answer.(type) {
+		case *dns.A:
+			ips = append(ips, rr.A)
+		case *dns.AAAA:
+			ips = append(ips, rr.AAAA)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("%w: no address for %s", errHostNotFound, name)
+	}
+	return ips, nil
+}
+
+// parseServers splits a comma separated upstream list.
+func parseServers(list string) []string {
+	var servers []string
+	for _, server := range strings.Split(list, ",") {
+		if server = strings.TrimSpace(server); server != "" {
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Directions of a TCP session, each is shaped on its own.
+const (
+	dirUpload   = iota // client to remote
+	dirDownload        // remote to client
+)
+
+// A paused direction waits until this many bytes may be read again,
+// so a throttled session does not wake up for every few bytes.
+const minShapedRead = 4096
+
+// bandwidthShaper holds the token buckets shared between sessions. Rates are
+// bytes per second per direction, the burst is one second worth of traffic.
+// UDP associations are not shaped.
+type bandwidthShaper struct {
+	global [2]*tokenBucket
+	users  map[string]*userBandwidth
+}
+
+type userBandwidth struct {
+	buckets  [2]*tokenBucket
+	sessions int
+}
+
+func newBandwidthShaper() *bandwidthShaper {
+	return &bandwidthShaper{users: make(map[string]*userBandwidth)}
+}
+
+func shapingBucket(b *tokenBucket, rate int64, now time.Time) *tokenBucket {
+	burst := float64(max(rate, minShapedRead))
+	if b == nil {
+		return newTokenBucket(float64(rate), burst, now)
+	}
+	b.refill(now)
+	b.rate, b.burst = float64(rate), burst
+	b.tokens = min(b.tokens, burst)
+	return b
+}
+
+// startShaping picks the buckets limiting client once it starts relaying.
+// Shared buckets follow the configuration of the moment, the per-session
+// rate stays what it was when the session started.
+func (p *Proxy) startShaping(client *ClientConn) {
+	cfg, s := p.cfg.Bandwidth, p.shaper
+	now := time.Now()
+
+	for dir := range client.shape {
+		client.shape[dir] = nil
+	}
+	if cfg.Global > 0 {
+		for dir := range s.global {
+			s.global[dir] = shapingBucket(s.global[dir], cfg.Global, now)
+			client.shape[dir] = append(client.shape[dir], s.global[dir])
+		}
+	}
+	if cfg.PerUser > 0 && client.user != "" {
+		u, ok := s.users[client.user]
+		if !ok {
+			u = &userBandwidth{}
+			s.users[client.user] = u
+		}
+		u.sessions++
+		client.shapedUser = client.user
+		for dir := range u.buckets {
+			u.buckets[dir] = shapingBucket(u.buckets[dir], cfg.PerUser, now)
+			client.shape[dir] = append(client.shape[dir], u.buckets[dir])
+		}
+	}
+	if cfg.PerSession > 0 {
+		for dir := range client.shape {
+			client.shape[dir] = append(client.shape[dir], shapingBucket(nil, cfg.PerSession, now))
+		}
+	}
+}
+
+// stopShaping forgets the buckets of a closed session.
+func (p *Proxy) stopShaping(client *ClientConn) {
+	for dir := range client.resume {
+		p.timers.stop(client.resume[dir])
+	}
+	if client.shapedUser == "" {
+		return
+	}
+	if u := p.shaper.users[client.shapedUser]; u != nil {
+		if u.sessions--; u.sessions <= 0 {
+			delete(p.shaper.users, client.shapedUser)
+		}
+	}
+	client.shapedUser = ""
+}
+
+// readAllowance returns how many bytes the buckets of client allow in dir right now.
+func (p *Proxy) readAllowance(client *ClientConn, dir int) int {
+	allowance := p.bufferSize
+	now := time.Now()
+	for _, b := range client.shape[dir] {
+		b.refill(now)
+		allowance = min(allowance, int(b.tokens))
+	}
+	return max(allowance, 0)
+}
+
+// shapedRead reads from fd what the buckets of dir allow and pauses reading
+// in that direction once they are empty.
+func (p *Proxy) shapedRead(client *ClientConn, dir int, fd int, out *[]byte) (eof bool, err error) {
+	limit := p.readAllowance(client, dir)
+	if limit > 0 {
+		var n int
+		n, eof, err = p.readInto(fd, out, limit)
+		p.countTraffic(client, n)
+		metrics.bytesRelayed.add(directionNames[dir], uint64(n))
+		client.relayed[dir] += int64(n)
+		if client.capture != nil {
+			client.capture.data(dir, (*out)[len(*out)-n:])
+		}
+		if client.sniffing && dir == dirUpload {
+			client.sniffed = append(client.sniffed, (*out)[len(*out)-n:]...)
+		}
+		for _, b := range client.shape[dir] {
+			b.tokens -= float64(n)
+		}
+	}
+	if len(client.shape[dir]) > 0 && p.readAllowance(client, dir) < minShapedRead {
+		p.pauseReads(client, dir)
+	}
+	return eof, err
+}
+
+// pauseReads stops reading in dir until the slowest bucket has refilled enough,
+// updateInterest leaves EPOLLIN out meanwhile.
+func (p *Proxy) pauseReads(client *ClientConn, dir int) {
+	if client.throttled[dir] {
+		return
+	}
+
+	var wait time.Duration
+	for _, b := range client.shape[dir] {
+		needed := min(minShapedRead, b.burst) - b.tokens
+		if needed > 0 {
+			wait = max(wait, time.Duration(needed/b.rate*float64(time.Second)))
+		}
+	}
+	if wait <= 0 {
+		return
+	}
+
+	client.throttled[dir] = true
+	client.resume[dir] = p.timers.after(wait, func() {
+		client.resume[dir] = nil
+		client.throttled[dir] = false
+		if !client.closed {
+			p.abortOnError(client, p.unpark(client, dir))
+		}
+	})
+}
+
+// readFd returns the socket read in dir.
+func (c *ClientConn) readFd(dir int) int {
+	if dir == dirUpload {
+		return c.clientFd
+	}
+	return c.remoteFd
+}
+
+// parkHungUp takes the socket read in a throttled direction out of epoll once
+// it hung up. EPOLLHUP cannot be masked and would wake the loop over and over
+// until the resume timer fires. Nothing can be written to such a socket anyway.
+func (p *Proxy) parkHungUp(client *ClientConn, dir int, events uint32) error {
+	if events&unix.EPOLLHUP == 0 || !client.throttled[dir] || client.parked[dir] {
+		return nil
+	}
+	if err := unix.EpollCtl(p.epollFd, unix.EPOLL_CTL_DEL, client.readFd(dir), nil); err != nil {
+		return err
+	}
+	client.parked[dir] = true
+	return nil
+}
+
+// unpark returns a parked socket to epoll once its direction may read again.
+func (p *Proxy) unpark(client *ClientConn, dir int) error {
+	if client.parked[dir] {
+		fd := client.readFd(dir)
+		if err := unix.EpollCtl(p.epollFd, unix.EPOLL_CTL_ADD, fd, &unix.EpollEvent{Fd: int32(fd)}); err != nil {
+			return err
+		}
+		client.parked[dir] = false
+		if dir == dirUpload {
+			client.clientEvents = 0
+		} else {
+			client.remoteEvents = 0
+		}
+	}
+	return p.updateInterest(client)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+const defaultDrainTimeout = 30 * time.Second
+
+var errShuttingDown = errors.New("proxy is shutting down")
+
+// shutdownState is set once a shutdown has begun.
+type shutdownState struct {
+	started    time.Time
+	timer      *timer
+	handshakes int
+	draining   int
+	forced     int
+	forcing    bool
+	// done makes Run return at the end of the current iteration.
+	done bool
+}
+
+// Shutdown stops accepting connections and lets established sessions finish,
+// up to the drain timeout. Calling it again while draining closes the rest at once.
+// Safe to call from any goroutine except the event loop.
+func (p *Proxy) Shutdown() error {
+	return p.call(func() error {
+		if p.shutdown != nil {
+			if !p.shutdown.done {
+				p.forceClose()
+			}
+			return nil
+		}
+		p.beginShutdown()
+		return nil
+	})
+}
+
+func (p *Proxy) beginShutdown() {
+	drainTimeout := p.cfg.Timeouts.Drain
+	state := &shutdownState{started: time.Now()}
+	p.closeListeners()
+
+	// Sessions still negotiating are not worth waiting for.
+	for fd, client := range p.conns {
+		if fd != client.clientFd {
+			continue
+		}
+		switch client.stage {
+		case establish, associate:
+		default:
+			state.handshakes++
+			client.noteClose("shutdown")
+			p.closeClient(fd)
+		}
+	}
+
+	p.shutdown = state
+	state.draining = p.sessionCount()
+	infof("Shutting down, draining %d sessions for up to %s", state.draining, drainTimeout)
+	if state.draining == 0 {
+		p.finishShutdown()
+		return
+	}
+	state.timer = p.timers.after(drainTimeout, func() {
+		state.timer = nil
+		p.forceClose()
+	})
+}
+
+// forceClose closes every session left and ends the loop.
+func (p *Proxy) forceClose() {
+	p.shutdown.forcing = true
+	for fd, client := range p.conns {
+		if fd == client.clientFd {
+			p.shutdown.forced++
+			client.noteClose("shutdown")
+			p.closeClient(fd)
+		}
+	}
+	p.finishShutdown()
+}
+
+// sessionClosed is called by closeClient to notice when draining is complete.
+func (p *Proxy) sessionClosed() {
+	s := p.shutdown
+	if s == nil || s.forcing || s.done {
+		return
+	}
+	if p.sessionCount() == 0 {
+		p.finishShutdown()
+	}
+}
+
+func (p *Proxy) finishShutdown() {
+	s := p.shutdown
+	s.done = true
+	p.timers.stop(s.timer)
+
+	infof("Shutdown complete after %s: %d handshakes aborted, %d sessions drained, %d force-closed",
+		time.Since(s.started).Round(time.Millisecond), s.handshakes, s.draining-s.forced, s.forced)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Sniffing gives up once this much client data arrived without a complete
+// ClientHello or request header. A ClientHello fits into one TLS record.
+const maxSniffSize = 16*1024 + 5
+
+// Client data held back for the server name is forwarded after this long at the
+// latest, the client may be waiting for the server to speak first.
+const sniffHoldTimeout = 500 * time.Millisecond
+
+const (
+	tlsRecordHandshake  = 0x16
+	tlsClientHello      = 0x01
+	tlsExtServerName    = 0x0000
+	tlsServerNameHost   = 0x00
+	tlsRecordHeaderSize = 5
+)
+
+// sniffName extracts the server name from the first bytes a client sends: the SNI
+// of a TLS ClientHello or the Host header of an HTTP request. done is false while
+// more data is needed, an empty name with done set means there is none.
+func sniffName(b []byte) (name string, done bool) {
+	switch {
+	case len(b) == 0:
+		return "", false
+	case b[0] == tlsRecordHandshake:
+		return sniffSNI(b)
+	case looksLikeHTTP(b[0]):
+		return sniffHost(b)
+	}
+	return "", true
+}
+
+// sniffSNI collects the ClientHello from one or more handshake records and
+// returns its server_name extension.
+func sniffSNI(b []byte) (string, bool) {
+	var hello []byte
+	for {
+		if len(b) < tlsRecordHeaderSize {
+			return "", false
+		}
+		if b[0] != tlsRecordHandshake {
+			return "", true
+		}
+		length := int(binary.BigEndian.Uint16(b[3:5]))
+		if len(b) < tlsRecordHeaderSize+length {
+			return "", false
+		}
+		hello = append(hello, b[tlsRecordHeaderSize:tlsRecordHeaderSize+length]...)
+		b = b[tlsRecordHeaderSize+length:]
+
+		if len(hello) < 4 {
+			continue
+		}
+		if hello[0] != tlsClientHello {
+			return "", true
+		}
+		size := 4 + (int(hello[1])<<16 | int(hello[2])<<8 | int(hello[3]))
+		if len(hello) >= size {
+			return parseClientHelloSNI(hello[4:size]), true
+		}
+	}
+}
+
+// parseClientHelloSNI walks the ClientHello body to the server_name extension.
+func parseClientHelloSNI(hello []byte) string {
+	r := tlsReader(hello)
+	if !r.skip(2+32) || // legacy_version, random
+		!r.skipVector(1) || // legacy_session_id
+		!r.skipVector(2) || // cipher_suites
+		!r.skipVector(1) { // legacy_compression_methods
+		return ""
+	}
+	extensions, ok := r.vector(2)
+	if !ok {
+		return ""
+	}
+
+	for len(extensions) >= 4 {
+		typ := binary.BigEndian.Uint16(extensions)
+		data, ok := extensions[2:].vector(2)
+		if !ok {
+			return ""
+		}
+		extensions = extensions[2+2+len(data):]
+		if typ != tlsExtServerName {
+			continue
+		}
+
+		list, ok := data.vector(2)
+		for ok && len(list) >= 3 {
+			nameType := list[0]
+			var name tlsReader
+			if name, ok = list[1:].vector(2); !ok {
+				break
+			}
+			if nameType == tlsServerNameHost {
+				return strings.ToLower(strings.TrimSuffix(string(name), "."))
+			}
+			list = list[1+2+len(name):]
+		}
+		return ""
+	}
+	return ""
+}
+
+// tlsReader reads the length-prefixed vectors of TLS messages.
+type tlsReader []byte
+
+func (r *tlsReader) skip(n int) bool {
+	if len(*r) < n {
+		return false
+	}
+	*r = (*r)[n:]
+	return true
+}
+
+// vector returns the contents of a vector with a lenBytes long length at the front of r.
+func (r tlsReader) vector(lenBytes int) (tlsReader, bool) {
+	if len(r) < lenBytes {
+		return nil, false
+	}
+	n := 0
+	for _, b := range r[:lenBytes] {
+		n = n<<8 | int(b)
+	}
+	if len(r) < lenBytes+n {
+		return nil, false
+	}
+	return r[lenBytes : lenBytes+n], true
+}
+
+func (r *tlsReader) skipVector(lenBytes int) bool {
+	v, ok := r.vector(lenBytes)
+	return ok && r.skip(lenBytes+len(v))
+}
+
+// sniffHost returns the Host header of a complete HTTP request header, without port.
+// Other line based protocols are told apart by their first line.
+func sniffHost(b []byte) (string, bool) {
+	lineEnd := bytes.Index(b, []byte("\r\n"))
+	if lineEnd < 0 {
+		return "", false
+	}
+	if _, _, _, ok := parseRequestLine(string(b[:lineEnd])); !ok {
+		return "", true
+	}
+	end := bytes.Index(b, []byte("\r\n\r\n"))
+	if end < 0 {
+		return "", false
+	}
+	for _, line := range strings.Split(string(b[:end]), "\r\n")[1:] {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok || http.CanonicalHeaderKey(strings.TrimSpace(key)) != "Host" {
+			continue
+		}
+		host := strings.TrimSpace(value)
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		return strings.ToLower(strings.Trim(host, "[]")), true
+	}
+	return "", true
+}
+
+// usesNames reports whether any of rules matches on the server name.
+func usesNames(rules []*aclRule) bool {
+	for _, rule := range rules {
+		if len(rule.names) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// startSniff starts looking for the server name in the first data of a CONNECT
+// session. Only if rules match on the name is the data held back until the name
+// is found or known to be missing, so that they can still refuse the session
+// before anything reaches the target. Otherwise the data is copied as it passes.
+// Either way it is forwarded unchanged.
+func (p *Proxy) startSniff(client *ClientConn) {
+	client.sniffing = true
+	client.holding = p.holdForName
+	client.sniffed = append([]byte(nil), client.toRemote...)
+	if !client.holding {
+		return
+	}
+	client.sniffTimer = p.timers.after(sniffHoldTimeout, func() {
+		client.sniffTimer = nil
+		if client.closed || !client.sniffing {
+			return
+		}
+		debugf("Client %d%s sent no server name within %s", client.clientFd, client.userTag(), sniffHoldTimeout)
+		err := p.stopSniff(client, "")
+		if err == nil {
+			err = flushTo(client.remoteFd, &client.toRemote)
+		}
+		if err == nil {
+			err = p.finishIO(client)
+		}
+		p.abortOnError(client, err)
+	})
+}
+
+// sniff looks for the server name in the client data seen so far.
+func (p *Proxy) sniff(client *ClientConn) error {
+	if !client.sniffing {
+		return nil
+	}
+	name, done := sniffName(client.sniffed)
+	// Held back data fills the relay buffer, which may be smaller than the limit.
+	if !done && !client.clientEOF && len(client.sniffed) < min(maxSniffSize, p.bufferSize) {
+		return nil
+	}
+	return p.stopSniff(client, name)
+}
+
+// stopSniff records the server name, or that there is none, and checks the rules
+// again. The caller forwards the data held back.
+func (p *Proxy) stopSniff(client *ClientConn, name string) error {
+	p.timers.stop(client.sniffTimer)
+	client.sniffTimer = nil
+	client.sniffing, client.holding, client.sniffed = false, false, nil
+	client.nameKnown = true
+	client.serverName = name
+	if name != "" {
+		debugf("Client %d%s server name %s", client.clientFd, client.userTag(), name)
+	}
+	if !p.allowed(client, client.targetHost, client.remoteIP, client.targetPort) {
+		return fmt.Errorf("%w: server name %q", errNotAllowed, name)
+	}
+	p.maybeCapture(client)
+	return nil
+}
@@ -1,206 +1,438 @@
 package main
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
+	"os"
+	"syscall"
 	"time"
 
-	"github.com/miekg/dns"
 	"golang.org/x/sys/unix"
 )
 
 const (
-	socksVersion5 = 0x05
-	cmdConnect    = 0x01
-	atypIP4       = 0x01
-	atypDomain    = 0x03
-	atypIP6       = 0x04
+	socksVersion4   = 0x04
+	socksVersion5   = 0x05
+	cmdConnect      = 0x01
+	cmdBind         = 0x02
+	cmdUDPAssociate = 0x03
+	atypIP4         = 0x01
+	atypDomain      = 0x03
+	atypIP6         = 0x04
+
+	repSuccess             = 0x00
+	repGeneralFailure      = 0x01
+	repNotAllowed          = 0x02
+	repNetworkUnreachable  = 0x03
+	repHostUnreachable     = 0x04
+	repConnectionRefused   = 0x05
+	repTTLExpired          = 0x06
+	repCommandNotSupported = 0x07
+	repAddrNotSupported    = 0x08
+)
+
+var (
+	errNotAllowed          = errors.New("connection not allowed by ruleset")
+	errHostNotFound        = errors.New("host not found")
+	errCommandNotSupported = errors.New("command not supported")
+	errAddrNotSupported    = errors.New("address type not supported")
 )
 
 type stage int
 
 const (
 	auth stage = iota
+	login
 	request
+	connecting
 	establish
+	associate
+	bindWait
 )
 
+var stageNames = []string{"auth", "login", "request", "connecting", "establish", "associate", "bind_wait"}
+
+func (s stage) String() string {
+	return stageNames[s]
+}
+
 type Proxy struct {
-	listener *net.TCPListener
+	listeners   map[int]*net.TCPListener
+	listenAddrs map[string]int
+	epollFd     int
+	// Work handed to the loop by other goroutines, e.g. reloads.
+	tasks    *taskQueue
 	conns    map[int]*ClientConn
-	dnsConn  *net.UDPConn
-	dnsMap   map[uint16]*ClientConn
+	resolver *Resolver
+	timers   timerQueue
+	creds    *Credentials
+	acl      *ACL
+	udpBuf   []byte
+	relayBuf []byte
+
+	// The id of the last accepted session, ids are not reused as fds are.
+	lastSessionID uint64
+
+	// Reading from a side stops while the buffer towards the other side holds this much.
+	bufferSize int
+	preferIPv4 bool
+
+	// The configuration in use, args reproduce it on reload.
+	cfg           *Config
+	args          []string
+	controlPath   string
+	control       net.Listener
+	metricsAddr   string
+	metricsServer *http.Server
+	adminAddr     string
+	adminServer   *http.Server
+	accessLog     *accessLog
+	captureRules  []*aclRule
+	routes        []upstreamRoute
+	// Set if rules match on the server name, see startSniff.
+	holdForName bool
+
+	limits *sessionLimits
+	shaper *bandwidthShaper
+	quotas *quotaStore
+	// Set once Shutdown was called.
+	shutdown *shutdownState
 }
 
 type ClientConn struct {
+	id          uint64
 	clientFd    int
-	clientConn  *net.TCPConn
+	clientAddr  *net.TCPAddr
+	localAddr   *net.TCPAddr
 	remoteFd    int
-	remoteConn  *net.TCPConn
 	stage       stage
+	version     byte
 	buffer      []byte
-	readOffset  int
 	writeOffset int
 	targetHost  string
 	targetPort  uint16
-	dnsQueryID  uint16
+	user        string
+	userID      string
+	httpForward []byte
+	closed      bool
+	// Set while the credentials are checked off the loop, see verifyLogin.
+	verifying bool
+	dial      *dialState
+	// The upstream proxy the session goes through, see connectToRemote.
+	upstream      *upstreamProxy
+	upstreamState *upstreamHandshake
+	// What the session counts against the limits, see releaseClient.
+	countedIP   string
+	countedUser string
+	// Bandwidth shaping, see shapedRead.
+	shape      [2][]*tokenBucket
+	throttled  [2]bool
+	resume     [2]*timer
+	parked     [2]bool
+	shapedUser string
+	// Set once the quota of the user is used up, see countTraffic.
+	quotaCut bool
+	// The timer of the current stage and the last I/O, see armTimeout.
+	timeout    *timer
+	lastActive time.Time
+	// For the admin API.
+	started time.Time
+	relayed [2]int64
+	// For the access log, see logAccess.
+	remoteIP    net.IP
+	reply       int
+	replied     bool
+	closeReason string
+	// The server name found in the first client data, see sniff.
+	sniffing   bool
+	holding    bool
+	sniffed    []byte
+	sniffTimer *timer
+	nameKnown  bool
+	serverName string
+	// Set while the session is captured, see startCapture.
+	capture *sessionCapture
+
+	toRemote     []byte
+	toClient     []byte
+	clientEvents uint32
+	remoteEvents uint32
+	clientEOF    bool
+	remoteEOF    bool
+	clientShut   bool
+	remoteShut   bool
+	// Set when the client half-closed while its input was not read, see paused.
+	// The data before the EOF is still queued in the socket.
+	clientRDHUP bool
+
+	udpFd         int
+	udpExpect     *net.UDPAddr
+	udpClientAddr *net.UDPAddr
+	udpWaiting    map[string][][]byte
+	// Targets the client sent to, only they may send datagrams back.
+	udpPeers map[string]bool
+
+	bindFd       int
+	bindListener *net.TCPListener
+	bindExpect   net.IP
 }
 
-func NewProxy(port int) (*Proxy, error) {
-	addr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+// NewProxy listens on every address of listen. IPv6 addresses are bound
+// IPv6-only, IPv4 clients are expected on their own listener.
+func NewProxy(listen []string, bufferSize int, creds *Credentials, resolver *Resolver) (*Proxy, error) {
+	p := &Proxy{
+		listeners:   make(map[int]*net.TCPListener),
+		listenAddrs: make(map[string]int),
+		limits:      newSessionLimits(),
+		shaper:      newBandwidthShaper(),
+		conns:       make(map[int]*ClientConn),
+		resolver:    resolver,
+		creds:       creds,
+		udpBuf:      make([]byte, 65535),
+		relayBuf:    make([]byte, bufferSize),
+		bufferSize:  bufferSize,
+	}
+
+	tasks, err := newTaskQueue()
 	if err != nil {
 		return nil, err
 	}
+	p.tasks = tasks
 
-	listener, err := net.ListenTCP("tcp", addr)
-	if err != nil {
-		return nil, err
+	for _, addr := range listen {
+		if _, err := p.listen(addr); err != nil {
+			p.closeListeners()
+			tasks.stop()
+			return nil, err
+		}
 	}
+	return p, nil
+}
+
+// listen opens a listener on addr, it is polled once registerListener is called.
+func (p *Proxy) listen(addr string) (int, error) {
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		if network != "tcp6" {
+			return nil
+		}
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_V6ONLY, 1)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}}
 
-	dnsConn, err := net.DialUDP("udp", nil, &net.UDPAddr{
-		IP:   net.IPv4(8, 8, 8, 8),
-		Port: 53,
-	})
+	ln, err := lc.Listen(context.Background(), "tcp", addr)
 	if err != nil {
-		return nil, err
+		return -1, err
 	}
+	listener := ln.(*net.TCPListener)
 
-	return &Proxy{
-		listener: listener,
-		conns:    make(map[int]*ClientConn),
-		dnsConn:  dnsConn,
-		dnsMap:   make(map[uint16]*ClientConn),
-	}, nil
+	fd, err := listenerFd(listener)
+	if err != nil {
+		listener.Close()
+		return -1, err
+	}
+	p.listeners[fd] = listener
+	p.listenAddrs[addr] = fd
+	return fd, nil
 }
 
-func (p *Proxy) Run() error {
-	listenerFd, err := p.getFdFromConn(p.listener)
-	if err != nil {
+func (p *Proxy) registerListener(fd int) error {
+	if err := unix.EpollCtl(p.epollFd, unix.EPOLL_CTL_ADD, fd, &unix.EpollEvent{
+		Events: unix.EPOLLIN,
+		Fd:     int32(fd),
+	}); err != nil {
 		return err
 	}
-	defer unix.Close(listenerFd)
+	infof("Proxy listening on %s", p.listeners[fd].Addr())
+	return nil
+}
 
-	dnsFd, err := p.getFdFromConn(p.dnsConn)
-	if err != nil {
-		return err
+func (p *Proxy) closeListener(fd int) {
+	p.listeners[fd].Close()
+	delete(p.listeners, fd)
+	for addr, addrFd := range p.listenAddrs {
+		if addrFd == fd {
+			delete(p.listenAddrs, addr)
+		}
 	}
-	defer unix.Close(dnsFd)
+}
+
+func (p *Proxy) closeListeners() {
+	for fd := range p.listeners {
+		p.closeListener(fd)
+	}
+}
+
+func (p *Proxy) Run() error {
+	defer p.saveQuotas()
+	defer func() { p.accessLog.close() }()
+	defer p.closeListeners()
+	defer p.closeControl()
+	defer p.closeMetrics()
+	defer p.closeAdmin()
 
 	epollFd, err := unix.EpollCreate1(0)
 	if err != nil {
 		return err
 	}
 	defer unix.Close(epollFd)
+	p.epollFd = epollFd
+
+	for fd := range p.listeners {
+		if err := p.registerListener(fd); err != nil {
+			return err
+		}
+	}
 
-	if err := unix.EpollCtl(epollFd, unix.EPOLL_CTL_ADD, listenerFd, &unix.EpollEvent{
+	defer p.tasks.stop()
+	if err := unix.EpollCtl(epollFd, unix.EPOLL_CTL_ADD, p.tasks.fd, &unix.EpollEvent{
 		Events: unix.EPOLLIN,
-		Fd:     int32(listenerFd),
+		Fd:     int32(p.tasks.fd),
 	}); err != nil {
 		return err
 	}
 
-	if err := unix.EpollCtl(epollFd, unix.EPOLL_CTL_ADD, dnsFd, &unix.EpollEvent{
-		Events: unix.EPOLLIN,
-		Fd:     int32(dnsFd),
-	}); err != nil {
+	if err := p.resolver.register(epollFd); err != nil {
 		return err
 	}
+	defer p.resolver.close()
 
 	events := make([]unix.EpollEvent, 64)
 	for {
-		n, err := unix.EpollWait(epollFd, events, -1)
+		now := time.Now()
+		timeout := minTimeout(p.resolver.nextTimeout(now), p.timers.nextTimeout(now))
+		n, err := unix.EpollWait(epollFd, events, timeout)
 		if err != nil {
 			if errors.Is(err, unix.EINTR) {
 				continue
 			}
 			return err
 		}
+		woke := time.Now()
 
 		for i := 0; i < n; i++ {
 			fd := int(events[i].Fd)
 
+			_, isListener := p.listeners[fd]
+
 			switch {
-			case fd == listenerFd:
-				if err := p.acceptClient(epollFd); err != nil {
-					log.Printf("Accept error: %v", err)
-				}
-			case fd == dnsFd:
-				if err := p.handleDNSResponse(); err != nil {
-					log.Printf("DNS error: %v", err)
+			case isListener:
+				if err := p.acceptClient(fd, epollFd); err != nil {
+					errorf("Accept error: %v", err)
 				}
+			case fd == p.tasks.fd:
+				p.tasks.run()
+			case p.resolver.owns(fd):
+				p.resolver.handleEvent(fd, events[i].Events)
 			default:
 				if err := p.handleClientData(fd, epollFd, events[i].Events); err != nil {
-					log.Printf("Client handling error: %v", err)
+					if !errors.Is(err, errSessionDone) {
+						warnf("Client handling error: %v", err)
+					}
+					if client, ok := p.conns[fd]; ok {
+						client.noteClose(err.Error())
+					}
 					p.closeClient(fd)
 				}
 			}
 		}
+
+		now = time.Now()
+		p.resolver.expire(now)
+		p.timers.run(now)
+		metrics.loopIteration.observe(time.Since(woke))
+
+		if p.shutdown != nil && p.shutdown.done {
+			return nil
+		}
 	}
 }
 
-func (p *Proxy) getFdFromConn(conn interface{}) (int, error) {
-	switch c := conn.(type) {
-	case *net.TCPListener:
-		f, err := c.File()
-		if err != nil {
-			return -1, err
-		}
-		return int(f.Fd()), nil
-	case *net.UDPConn:
-		f, err := c.File()
-		if err != nil {
-			return -1, err
-		}
-		return int(f.Fd()), nil
-	case *net.TCPConn:
-		f, err := c.File()
-		if err != nil {
-			return -1, err
-		}
-		return int(f.Fd()), nil
-	default:
-		return -1, errors.New("unsupported connection type")
+// listenerFd returns the socket of listener, which is non-blocking already.
+// It is not duplicated and is closed only by closing listener.
+func listenerFd(listener *net.TCPListener) (int, error) {
+	raw, err := listener.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+	fd := -1
+	if err := raw.Control(func(s uintptr) { fd = int(s) }); err != nil {
+		return -1, err
 	}
+	return fd, nil
 }
 
-func (p *Proxy) acceptClient(epollFd int) error {
-	clientConn, err := p.listener.AcceptTCP()
+// acceptTCP accepts a connection on listenFd as a non-blocking socket owned by the caller.
+func acceptTCP(listenFd int) (fd int, peer *net.TCPAddr, err error) {
+	fd, sa, err := unix.Accept4(listenFd, unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC)
 	if err != nil {
-		return err
+		return -1, nil, err
 	}
+	ip, port := sockaddrToIP(sa)
+	return fd, &net.TCPAddr{IP: ip, Port: port}, nil
+}
 
-	clientFd, err := p.getFdFromConn(clientConn)
+func (p *Proxy) acceptClient(listenFd int, epollFd int) error {
+	clientFd, clientAddr, err := acceptTCP(listenFd)
 	if err != nil {
-		clientConn.Close()
+		if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.ECONNABORTED) {
+			return nil
+		}
 		return err
 	}
 
-	if err := unix.SetNonblock(clientFd, true); err != nil {
-		clientConn.Close()
+	sa, err := unix.Getsockname(clientFd)
+	if err != nil {
 		unix.Close(clientFd)
 		return err
 	}
+	localIP, localPort := sockaddrToIP(sa)
+
+	ip := clientAddr.IP.String()
+	if err := p.admitClient(ip); err != nil {
+		warnf("Rejected connection from %s: %v", ip, err)
+		unix.Close(clientFd)
+		return nil
+	}
+
+	client := &ClientConn{
+		clientAddr:   clientAddr,
+		localAddr:    &net.TCPAddr{IP: localIP, Port: localPort},
+		stage:        auth,
+		clientEvents: unix.EPOLLIN,
+		started:      time.Now(),
+		countedIP:    ip,
+	}
 
 	if err := unix.EpollCtl(epollFd, unix.EPOLL_CTL_ADD, clientFd, &unix.EpollEvent{
-		Events: unix.EPOLLIN | unix.EPOLLET,
+		Events: unix.EPOLLIN,
 		Fd:     int32(clientFd),
 	}); err != nil {
-		clientConn.Close()
 		unix.Close(clientFd)
+		p.releaseClient(client)
 		return err
 	}
 
-	p.conns[clientFd] = &ClientConn{
-		clientFd:   clientFd,
-		clientConn: clientConn,
-		stage:      auth,
-		buffer:     make([]byte, 4096),
-	}
+	p.lastSessionID++
+	client.id = p.lastSessionID
+	client.clientFd = clientFd
+	p.conns[clientFd] = client
+	p.armHandshakeTimeout(client)
+	metrics.accepted.Add(1)
+	metrics.sessions.Add(1)
 
-	log.Printf("New client connected: %d", clientFd)
+	infof("New client connected: %d, session %d", clientFd, client.id)
 	return nil
 }
 
@@ -209,27 +441,97 @@ func (p *Proxy) handleClientData(fd int, epollFd int, events uint32) error {
 	if !ok {
 		return fmt.Errorf("unknown client: %d", fd)
 	}
+	client.lastActive = time.Now()
+
+	if fd == client.bindFd {
+		return p.handleBindEvent(client, events)
+	}
+
+	if fd == client.udpFd {
+		if events&unix.EPOLLIN != 0 {
+			if err := p.handleUDPRelay(client); err != nil {
+				return err
+			}
+		}
+		if events&unix.EPOLLERR != 0 {
+			return errors.New("UDP relay error")
+		}
+		return nil
+	}
 
-	if events&unix.EPOLLIN != 0 {
+	if client.dial != nil {
+		if _, ok := client.dial.attempts[fd]; ok {
+			return p.finishConnect(client, fd)
+		}
+	}
+
+	if fd == client.remoteFd {
+		if client.upstreamState != nil {
+			return p.handleUpstreamEvent(client, events)
+		}
+		return p.handleRemoteEvent(client, events)
+	}
+
+	if events&unix.EPOLLERR != 0 {
+		return errors.New("connection error")
+	}
+
+	if events&(unix.EPOLLIN|unix.EPOLLHUP) != 0 {
 		if err := p.readFromClient(client); err != nil {
 			return err
 		}
+		if err := p.parkHungUp(client, dirUpload, events); err != nil {
+			return err
+		}
 	}
 
-	if events&unix.EPOLLOUT != 0 {
-		// gonna use it if decide to rewrite without the best of the best goroutines.
+	if client.paused() {
+		if events&unix.EPOLLHUP != 0 {
+			return errors.New("client disconnected")
+		}
+		// A client may send its request and data and then shut down its side.
+		// Both are read once the session goes on, only stop watching for now.
+		if events&unix.EPOLLRDHUP != 0 {
+			client.clientRDHUP = true
+		}
+	}
+	if events&unix.EPOLLHUP != 0 && client.clientEOF {
+		return errSessionDone
 	}
 
-	if events&(unix.EPOLLHUP|unix.EPOLLERR) != 0 {
-		return errors.New("connection error")
+	if events&unix.EPOLLOUT != 0 {
+		if err := flushTo(client.clientFd, &client.toClient); err != nil {
+			return err
+		}
 	}
 
-	return nil
+	return p.finishIO(client)
+}
+
+// paused reports whether client input is left unread until the session goes on:
+// while the remote side is not there yet or credentials are checked.
+func (c *ClientConn) paused() bool {
+	return c.stage == connecting || c.stage == bindWait || c.verifying
 }
 
+// Handshake messages and HTTP request headers are small, more pending input than this means a broken client.
+const maxHandshakeSize = 16 * 1024
+
 func (p *Proxy) readFromClient(client *ClientConn) error {
 	for {
-		n, err := unix.Read(client.clientFd, client.buffer[client.readOffset:])
+		if client.paused() {
+			// Anything read from now on is handled once the session goes on.
+			return nil
+		}
+		if client.stage == establish {
+			return p.relayFromClient(client)
+		}
+
+		if len(client.buffer) >= maxHandshakeSize {
+			return errors.New("handshake too large")
+		}
+
+		n, err := unix.Read(client.clientFd, p.relayBuf[:maxHandshakeSize-len(client.buffer)])
 		if err != nil {
 			if errors.Is(err, unix.EAGAIN) {
 				break
@@ -240,284 +542,370 @@ func (p *Proxy) readFromClient(client *ClientConn) error {
 			return errors.New("client disconnected")
 		}
 
-		client.readOffset += n
+		client.buffer = append(client.buffer, p.relayBuf[:n]...)
 
+		if err := p.processHandshake(client); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// processHandshake handles every complete message in the client buffer.
+// Bytes following the last message stay in the buffer.
+func (p *Proxy) processHandshake(client *ClientConn) error {
+	for len(client.buffer) > 0 && !client.verifying {
+		before := client.stage
+
+		var err error
 		switch client.stage {
 		case auth:
-			if err := p.handleAuth(client); err != nil {
-				return err
-			}
+			err = p.handleAuth(client)
+		case login:
+			err = p.handleLogin(client)
 		case request:
-			if err := p.handleRequest(client); err != nil {
-				return err
-			}
-		case establish:
-			if client.remoteConn != nil {
-				if _, err := client.remoteConn.Write(client.buffer[:client.readOffset]); err != nil {
-					return err
-				}
-				client.readOffset = 0
-			}
+			err = p.handleRequest(client)
+		case associate:
+			// The TCP connection only keeps the association alive.
+			client.buffer = client.buffer[:0]
+		default:
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// Every handler moves to the next stage once its message is complete.
+		if client.stage == before {
+			return nil
 		}
 	}
 	return nil
 }
 
+// consume drops n handled bytes from the front of the client buffer.
+func (c *ClientConn) consume(n int) {
+	rest := copy(c.buffer, c.buffer[n:])
+	c.buffer = c.buffer[:rest]
+}
+
 func (p *Proxy) handleAuth(client *ClientConn) error {
-	if client.readOffset < 2 {
+	if len(client.buffer) < 2 {
 		return nil
 	}
 
+	if client.buffer[0] == socksVersion4 {
+		// SOCKS4 has no method negotiation, the request comes right away.
+		client.version = socksVersion4
+		client.stage = request
+		return nil
+	}
+	if looksLikeHTTP(client.buffer[0]) {
+		// An HTTP proxy request, the method is the first thing on the wire.
+		client.version = protoHTTP
+		client.stage = request
+		return nil
+	}
 	if client.buffer[0] != socksVersion5 {
 		return fmt.Errorf("unsupported SOCKS version: %d", client.buffer[0])
 	}
+	client.version = socksVersion5
 
 	nMethods := int(client.buffer[1])
-	if client.readOffset < 2+nMethods {
+	if len(client.buffer) < 2+nMethods {
 		return nil
 	}
 
-	// So we do not support any auth so far.
-	noAuthSupported := false
+	// Username/password is mandatory once credentials are configured.
+	method := byte(authNone)
+	if p.creds != nil {
+		method = authUserPass
+	}
+
+	methodSupported := false
 	for i := 0; i < nMethods; i++ {
-		if client.buffer[2+i] == 0x00 {
-			noAuthSupported = true
+		if client.buffer[2+i] == method {
+			methodSupported = true
 			break
 		}
 	}
 
-	if !noAuthSupported {
-		response := []byte{socksVersion5, 0xFF}
-		if _, err := unix.Write(client.clientFd, response); err != nil {
+	if !methodSupported {
+		response := []byte{socksVersion5, authNoAcceptable}
+		if err := p.sendToClient(client, response); err != nil {
 			return err
 		}
 		return errors.New("no supported auth methods")
 	}
 
-	response := []byte{socksVersion5, 0x00}
-	if _, err := unix.Write(client.clientFd, response); err != nil {
+	response := []byte{socksVersion5, method}
+	if err := p.sendToClient(client, response); err != nil {
 		return err
 	}
 
+	client.consume(2 + nMethods)
+	if method == authUserPass {
+		client.stage = login
+		return nil
+	}
+
 	client.stage = request
-	client.readOffset = 0
-	log.Printf("Client %d authenticated", client.clientFd)
+	infof("Client %d authenticated", client.clientFd)
 	return nil
 }
 
 func (p *Proxy) handleRequest(client *ClientConn) error {
-	if client.readOffset < 4 {
+	switch client.version {
+	case socksVersion4:
+		return p.handleSocks4Request(client)
+	case protoHTTP:
+		return p.handleHTTPRequest(client)
+	}
+
+	if len(client.buffer) < 4 {
 		return nil
 	}
 
 	if client.buffer[0] != socksVersion5 {
 		return fmt.Errorf("invalid SOCKS version in request: %d", client.buffer[0])
 	}
-	if client.buffer[1] != cmdConnect {
-		return fmt.Errorf("unsupported command: %d", client.buffer[1])
+	cmd := client.buffer[1]
+	if cmd != cmdConnect && cmd != cmdBind && cmd != cmdUDPAssociate {
+		return p.failRequest(client, fmt.Errorf("%w: %d", errCommandNotSupported, cmd))
 	}
 
-	aTyp := client.buffer[3]
-	var host string
-
-	switch aTyp {
-	case atypIP4:
-		if client.readOffset < 10 {
-			return nil
-		}
-		host = net.IP(client.buffer[4:8]).String()
-		client.targetPort = binary.BigEndian.Uint16(client.buffer[8:10])
-	case atypDomain:
-		if client.readOffset < 5 {
-			return nil
-		}
-		domainLen := int(client.buffer[4])
-		if client.readOffset < 7+domainLen {
-			return nil
-		}
-		host = string(client.buffer[5 : 5+domainLen])
-		client.targetPort = binary.BigEndian.Uint16(client.buffer[5+domainLen : 7+domainLen])
-	case atypIP6:
-		if client.readOffset < 22 {
-			return nil
-		}
-		host = net.IP(client.buffer[4:20]).String()
-		client.targetPort = binary.BigEndian.Uint16(client.buffer[20:22])
-	default:
-		return fmt.Errorf("unsupported address type: %d", aTyp)
+	host, port, n, err := parseSocksAddr(client.buffer[3:])
+	if err != nil {
+		return p.failRequest(client, err)
+	}
+	if n == 0 {
+		return nil
 	}
 
 	client.targetHost = host
-	client.readOffset = 0
-
-	log.Printf("Client %d requesting connection to %s:%d", client.clientFd, host, client.targetPort)
+	client.targetPort = port
+	client.consume(3 + n)
 
-	if aTyp == atypDomain {
-		return p.resolveHost(client, host)
+	if cmd == cmdUDPAssociate {
+		infof("Client %d%s requesting UDP association from %s:%d", client.clientFd, client.userTag(), host, port)
+		return p.startUDPAssociate(client, &net.UDPAddr{IP: net.ParseIP(host), Port: int(port)})
 	}
-	return p.connectToRemote(client, host)
+	if cmd == cmdBind {
+		infof("Client %d%s requesting BIND for %s:%d", client.clientFd, client.userTag(), host, port)
+		return p.startBind(client, net.ParseIP(host))
+	}
+
+	infof("Client %d%s requesting connection to %s:%d", client.clientFd, client.userTag(), host, client.targetPort)
+
+	return p.connectToRemote(client)
 }
 
-func (p *Proxy) resolveHost(client *ClientConn, host string) error {
-	msg := new(dns.Msg)
-	msg.SetQuestion(dns.Fqdn(host), dns.TypeA)
-	msg.RecursionDesired = true
+// failRequest answers a request with the reply code matching err and returns err,
+// so the caller closes the client.
+func (p *Proxy) failRequest(client *ClientConn, err error) error {
+	p.sendReply(client, replyCode(err), net.IPv4zero, 0)
+	return err
+}
 
-	client.dnsQueryID = uint16(len(p.dnsMap) + 1)
-	msg.Id = client.dnsQueryID
-	p.dnsMap[client.dnsQueryID] = client
+// sendReply answers the request in the SOCKS version the client spoke.
+func (p *Proxy) sendReply(client *ClientConn, rep byte, ip net.IP, port int) error {
+	switch client.version {
+	case socksVersion4:
+		reply := buildSocks4Reply(rep, ip, port)
+		client.reply, client.replied = int(reply[1]), true
+		return p.sendToClient(client, reply)
+	case protoHTTP:
+		return p.sendHTTPReply(client, rep)
+	}
+	client.reply, client.replied = int(rep), true
+	return p.sendToClient(client, buildReply(rep, ip, port))
+}
 
-	rawMsg, err := msg.Pack()
-	if err != nil {
-		return err
+// replyCode maps an error of a request to the RFC 1928 reply code.
+func replyCode(err error) byte {
+	var netErr net.Error
+	var upstreamErr *upstreamError
+	switch {
+	case errors.As(err, &upstreamErr):
+		return upstreamErr.rep
+	case errors.Is(err, errNotAllowed):
+		return repNotAllowed
+	case errors.Is(err, unix.ENETUNREACH):
+		return repNetworkUnreachable
+	case errors.Is(err, unix.EHOSTUNREACH), errors.Is(err, errHostNotFound),
+		errors.Is(err, errDNSTimeout), errors.Is(err, errDNSFailure):
+		return repHostUnreachable
+	case errors.Is(err, unix.ECONNREFUSED):
+		return repConnectionRefused
+	case errors.Is(err, unix.ETIMEDOUT), errors.As(err, &netErr) && netErr.Timeout():
+		return repTTLExpired
+	case errors.Is(err, errCommandNotSupported):
+		return repCommandNotSupported
+	case errors.Is(err, errAddrNotSupported):
+		return repAddrNotSupported
+	default:
+		return repGeneralFailure
 	}
+}
 
-	_, err = p.dnsConn.Write(rawMsg)
-	if err != nil {
-		return err
-	}
+// buildReply encodes a SOCKS5 reply with the given bound address.
+func buildReply(rep byte, ip net.IP, port int) []byte {
+	response := []byte{socksVersion5, rep, 0x00}
+	return appendSocksAddr(response, ip, port)
+}
 
-	log.Printf("DNS query sent for %s (ID: %d)", host, client.dnsQueryID)
-	return nil
+// appendSocksAddr appends ATYP, address and port as used in replies and UDP headers.
+func appendSocksAddr(b []byte, ip net.IP, port int) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, atypIP4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, atypIP6)
+		b = append(b, ip.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port))
 }
 
-func (p *Proxy) handleDNSResponse() error {
-	buf := make([]byte, 512)
-	n, err := p.dnsConn.Read(buf)
-	if err != nil {
-		return err
+// sockaddrToIP extracts the IP and port of an inet sockaddr, the IP is nil for other families.
+func sockaddrToIP(sa unix.Sockaddr) (net.IP, int) {
+	switch addr := sa.(type) {
+	case *unix.SockaddrInet4:
+		return net.IP(addr.Addr[:]).To16(), addr.Port
+	case *unix.SockaddrInet6:
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, addr.Addr[:])
+		return ip, addr.Port
+	default:
+		return nil, 0
 	}
+}
 
-	msg := new(dns.Msg)
-	if err := msg.Unpack(buf[:n]); err != nil {
-		return err
+// parseSocksAddr decodes ATYP, address and port from the start of b.
+// It returns n == 0 if b does not hold the whole address yet.
+func parseSocksAddr(b []byte) (host string, port uint16, n int, err error) {
+	if len(b) < 1 {
+		return "", 0, 0, nil
 	}
 
-	client, ok := p.dnsMap[msg.Id]
-	if !ok {
-		return fmt.Errorf("unknown DNS query ID: %d", msg.Id)
+	switch b[0] {
+	case atypIP4:
+		if len(b) < 7 {
+			return "", 0, 0, nil
+		}
+		return net.IP(b[1:5]).String(), binary.BigEndian.Uint16(b[5:7]), 7, nil
+	case atypDomain:
+		if len(b) < 2 {
+			return "", 0, 0, nil
+		}
+		domainLen := int(b[1])
+		if len(b) < 4+domainLen {
+			return "", 0, 0, nil
+		}
+		return string(b[2 : 2+domainLen]), binary.BigEndian.Uint16(b[2+domainLen : 4+domainLen]), 4 + domainLen, nil
+	case atypIP6:
+		if len(b) < 19 {
+			return "", 0, 0, nil
+		}
+		return net.IP(b[1:17]).String(), binary.BigEndian.Uint16(b[17:19]), 19, nil
+	default:
+		return "", 0, 0, fmt.Errorf("%w: %d", errAddrNotSupported, b[0])
 	}
-	delete(p.dnsMap, msg.Id)
+}
 
-	if msg.Rcode != dns.RcodeSuccess {
-		return fmt.Errorf("DNS resolution failed: %d", msg.Rcode)
+// userTag returns a log suffix naming the authenticated user, if any.
+func (c *ClientConn) userTag() string {
+	if c.user == "" {
+		return ""
 	}
+	return fmt.Sprintf(" (%s)", c.user)
+}
 
-	var ip string
-	for _, answer := range msg.Answer {
-		if a, ok := answer.(*dns.A); ok {
-			ip = a.A.String()
-			break
+// closeClient tears down the whole session that owns fd.
+func (p *Proxy) closeClient(fd int) {
+	if client, ok := p.conns[fd]; ok {
+		infof("Closing client connection: %d%s", client.clientFd, client.userTag())
+		delete(p.conns, client.clientFd)
+
+		// Lookups still in flight see this and drop their answers.
+		client.closed = true
+		p.abortDial(client)
+		p.timers.stop(client.timeout)
+		p.releaseClient(client)
+		p.stopShaping(client)
+		p.timers.stop(client.sniffTimer)
+		unix.Close(client.clientFd)
+		if client.remoteFd != 0 {
+			delete(p.conns, client.remoteFd)
+			unix.Close(client.remoteFd)
 		}
-	}
+		if client.udpFd != 0 {
+			delete(p.conns, client.udpFd)
+			unix.Close(client.udpFd)
+		}
+		p.closeBindListener(client)
+		p.logAccess(client)
+		p.stopCapture(client)
 
-	if ip == "" {
-		return errors.New("no IP address found in DNS response")
+		metrics.sessions.Add(-1)
+		switch client.stage {
+		case establish, associate:
+		default:
+			// Sessions closed by a shutdown did not fail.
+			if p.shutdown == nil {
+				metrics.handshakeFailed.add(client.stage.String(), 1)
+			}
+		}
+		p.sessionClosed()
 	}
-
-	log.Printf("DNS resolved %s -> %s", client.targetHost, ip)
-	return p.connectToRemote(client, ip)
 }
 
-func (p *Proxy) connectToRemote(client *ClientConn, host string) error {
-	targetAddr := fmt.Sprintf("%s:%d", host, client.targetPort)
-	log.Printf("Connecting to %s", targetAddr)
-
-	remoteConn, err := net.DialTimeout("tcp", targetAddr, 10*time.Second)
+func main() {
+	cfg, command, err := LoadConfig(os.Args[1:])
 	if err != nil {
-		response := []byte{socksVersion5, 0x01, 0x00, 0x01, 0, 0, 0, 0, 0, 0}
-		unix.Write(client.clientFd, response)
-		return err
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		log.Fatal(err)
+	}
+	if len(command) > 0 {
+		os.Exit(runControlCommand(cfg.Control, command))
 	}
 
-	remoteTCP := remoteConn.(*net.TCPConn)
-	remoteFd, err := p.getFdFromConn(remoteTCP)
+	s, err := loadSettings(cfg)
 	if err != nil {
-		remoteTCP.Close()
-		return err
+		log.Fatal(err)
 	}
 
-	if err := unix.SetNonblock(remoteFd, true); err != nil {
-		remoteTCP.Close()
-		unix.Close(remoteFd)
-		return err
+	resolver, err := NewResolver(s.servers, s.dnsTimeout, s.dnsAttempts, cfg.DNS.CacheSize)
+	if err != nil {
+		log.Fatal("Error creating resolver:", err)
 	}
 
-	client.remoteConn = remoteTCP
-	client.remoteFd = remoteFd
-
-	response := make([]byte, 10)
-	response[0] = socksVersion5
-	response[1] = 0x00
-	response[2] = 0x00
-	response[3] = 0x01
-	copy(response[4:8], net.IPv4(0, 0, 0, 0))
-	binary.BigEndian.PutUint16(response[8:10], 0)
-
-	if _, err := unix.Write(client.clientFd, response); err != nil {
-		remoteTCP.Close()
-		unix.Close(remoteFd)
-		return err
+	proxy, err := NewProxy(cfg.Listen, cfg.Buffers.Relay, s.creds, resolver)
+	if err != nil {
+		log.Fatal(err)
 	}
+	proxy.args = os.Args[1:]
+	proxy.applySettings(s)
 
-	client.stage = establish
-	log.Printf("Connection established to %s:%d", host, client.targetPort)
-
-	go p.relayData(client)
-
-	return nil
-}
-
-func (p *Proxy) relayData(client *ClientConn) {
-	defer p.closeClient(client.clientFd)
-
-	buffer := make([]byte, 4096)
-	for {
-		n, err := client.remoteConn.Read(buffer)
-		if err != nil {
-			break
-		}
-
-		if _, err := unix.Write(client.clientFd, buffer[:n]); err != nil {
-			break
+	if cfg.Control != "" {
+		if err := proxy.serveControl(cfg.Control); err != nil {
+			log.Fatal("Error opening control socket:", err)
 		}
 	}
-}
-
-func (p *Proxy) closeClient(fd int) {
-	if client, ok := p.conns[fd]; ok {
-		log.Printf("Closing client connection: %d", fd)
-		delete(p.conns, fd)
-
-		if client.clientConn != nil {
-			client.clientConn.Close()
-		}
-		if client.remoteConn != nil {
-			client.remoteConn.Close()
-		}
-		if client.dnsQueryID != 0 {
-			delete(p.dnsMap, client.dnsQueryID)
-		}
-		unix.Close(fd)
-		if client.remoteFd != 0 {
-			unix.Close(client.remoteFd)
+	if cfg.Metrics != "" {
+		if err := proxy.serveMetrics(cfg.Metrics); err != nil {
+			log.Fatal("Error serving metrics:", err)
 		}
 	}
-}
-
-func main() {
-	fmt.Print("Enter port: ")
-	var port int
-	_, err := fmt.Scan(&port)
-	if err != nil {
-		log.Fatal("Error reading port:", err)
+	if cfg.Admin != "" {
+		if err := proxy.serveAdmin(cfg.Admin); err != nil {
+			log.Fatal("Error serving admin API:", err)
+		}
 	}
+	proxy.watchSignals()
 
-	proxy, err := NewProxy(port)
-	if err != nil {
+	if err := proxy.Run(); err != nil {
 		log.Fatal(err)
 	}
-
-	log.Printf("SOCKS5 proxy started on port %d", port)
-	log.Fatal(proxy.Run())
 }
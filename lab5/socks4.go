@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+const (
+	socks4Granted  = 0x5A
+	socks4Rejected = 0x5B
+)
+
+// handleSocks4Request parses a SOCKS4 or SOCKS4a request:
+// VN CD DSTPORT DSTIP USERID NUL [HOST NUL].
+func (p *Proxy) handleSocks4Request(client *ClientConn) error {
+	if len(client.buffer) < 9 {
+		return nil
+	}
+
+	userEnd := bytes.IndexByte(client.buffer[8:], 0)
+	if userEnd < 0 {
+		return nil
+	}
+	userEnd += 8
+
+	cmd := client.buffer[1]
+	port := binary.BigEndian.Uint16(client.buffer[2:4])
+	ip := net.IP(client.buffer[4:8])
+	host := ip.String()
+	n := userEnd + 1
+
+	// SOCKS4a: 0.0.0.x with x != 0 means the name follows the user ID.
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		hostEnd := bytes.IndexByte(client.buffer[n:], 0)
+		if hostEnd < 0 {
+			return nil
+		}
+		host = string(client.buffer[n : n+hostEnd])
+		n += hostEnd + 1
+	}
+
+	client.userID = string(client.buffer[8:userEnd])
+	client.targetHost = host
+	client.targetPort = port
+	client.consume(n)
+
+	if cmd != cmdConnect {
+		return p.failRequest(client, fmt.Errorf("%w: SOCKS4 %d", errCommandNotSupported, cmd))
+	}
+	// SOCKS4 has no passwords, so it cannot pass configured authentication.
+	if p.creds != nil {
+		return p.failRequest(client, fmt.Errorf("%w: SOCKS4 without authentication", errNotAllowed))
+	}
+
+	infof("Client %d (SOCKS4 user ID %q) requesting connection to %s:%d", client.clientFd, client.userID, host, port)
+	return p.connectToRemote(client)
+}
+
+// buildSocks4Reply encodes a SOCKS4 reply, only IPv4 addresses can be reported.
+func buildSocks4Reply(rep byte, ip net.IP, port int) []byte {
+	code := byte(socks4Rejected)
+	if rep == repSuccess {
+		code = socks4Granted
+	}
+
+	response := []byte{0x00, code}
+	response = binary.BigEndian.AppendUint16(response, uint16(port))
+	if ip4 := ip.To4(); ip4 != nil {
+		return append(response, ip4...)
+	}
+	return append(response, 0, 0, 0, 0)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+var errProxyStopped = errors.New("proxy is not running")
+
+// taskQueue hands functions from other goroutines to the event loop.
+// Posting writes to an eventfd that the loop polls next to the sockets.
+type taskQueue struct {
+	fd int
+
+	mu      sync.Mutex
+	tasks   []func()
+	stopped bool
+	// Closed by stop so that callers waiting for a dropped task return.
+	done chan struct{}
+}
+
+func newTaskQueue() (*taskQueue, error) {
+	fd, err := unix.Eventfd(0, unix.EFD_NONBLOCK|unix.EFD_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	return &taskQueue{fd: fd, done: make(chan struct{})}, nil
+}
+
+// post queues fn to run on the event loop. It reports false once the loop has stopped.
+func (q *taskQueue) post(fn func()) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.stopped {
+		return false
+	}
+	q.tasks = append(q.tasks, fn)
+
+	var one [8]byte
+	one[0] = 1
+	unix.Write(q.fd, one[:])
+	return true
+}
+
+// run executes the queued functions, called by the loop when the eventfd is readable.
+func (q *taskQueue) run() {
+	var counter [8]byte
+	unix.Read(q.fd, counter[:])
+
+	q.mu.Lock()
+	tasks := q.tasks
+	q.tasks = nil
+	q.mu.Unlock()
+
+	for _, fn := range tasks {
+		fn()
+	}
+}
+
+// stop rejects further tasks, the ones still queued are dropped.
+func (q *taskQueue) stop() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.stopped = true
+	q.tasks = nil
+	close(q.done)
+	unix.Close(q.fd)
+}
+
+// call runs fn on the event loop and waits for its result.
+// It must not be used from the loop itself.
+func (p *Proxy) call(fn func() error) error {
+	done := make(chan error, 1)
+	if !p.tasks.post(func() { done <- fn() }) {
+		return errProxyStopped
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-p.tasks.done:
+		return errProxyStopped
+	}
+}
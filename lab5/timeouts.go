@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	defaultHandshakeTimeout = 10 * time.Second
+	defaultLookupTimeout    = 10 * time.Second
+	defaultConnectTimeout   = 30 * time.Second
+	defaultIdleTimeout      = 5 * time.Minute
+)
+
+// Each session has one timer at a time, armed for the stage it is in:
+//
+//	auth, login, request   handshake timeout, the connection is closed
+//	connecting (resolving) lookup timeout, "host unreachable"
+//	connecting (dialing)   connect timeout, "TTL expired"
+//	bindWait               connect timeout, "TTL expired"
+//	establish, associate   idle timeout, the session is closed
+//
+// A zero timeout disables the timer of its stage.
+func (p *Proxy) armTimeout(client *ClientConn, d time.Duration, fire func()) {
+	p.timers.stop(client.timeout)
+	client.timeout = nil
+	if d <= 0 {
+		return
+	}
+	client.timeout = p.timers.after(d, func() {
+		client.timeout = nil
+		if !client.closed {
+			fire()
+		}
+	})
+}
+
+func (p *Proxy) armHandshakeTimeout(client *ClientConn) {
+	timeout := p.cfg.Timeouts.Handshake
+	p.armTimeout(client, timeout, func() {
+		warnf("Client %d handshake timed out after %s", client.clientFd, timeout)
+		if client.version == protoHTTP {
+			p.sendHTTPError(client, http.StatusRequestTimeout)
+		}
+		client.noteClose("handshake timeout")
+		p.closeClient(client.clientFd)
+	})
+}
+
+func (p *Proxy) armLookupTimeout(client *ClientConn) {
+	timeout := p.cfg.Timeouts.Lookup
+	host := client.dial.host
+	p.armTimeout(client, timeout, func() {
+		p.abortOnError(client, p.failRequest(client,
+			fmt.Errorf("%w: resolving %s took over %s", errDNSTimeout, host, timeout)))
+	})
+}
+
+// armConnectTimeout covers the whole connect race, or waiting for the inbound connection of BIND.
+func (p *Proxy) armConnectTimeout(client *ClientConn) {
+	timeout := p.cfg.Timeouts.Connect
+	p.armTimeout(client, timeout, func() {
+		p.abortOnError(client, p.failRequest(client,
+			fmt.Errorf("no connection to %s:%d within %s: %w", client.targetHost, client.targetPort, timeout, unix.ETIMEDOUT)))
+	})
+}
+
+// armIdleTimeout closes the session once nothing happened on it for the idle timeout.
+// Activity only updates lastActive, the timer re-arms itself for the time left.
+func (p *Proxy) armIdleTimeout(client *ClientConn) {
+	timeout := p.cfg.Timeouts.Idle
+	client.lastActive = time.Now()
+
+	var check func()
+	check = func() {
+		if left := timeout - time.Since(client.lastActive); left > 0 {
+			p.armTimeout(client, left, check)
+			return
+		}
+		infof("Client %d%s idle for %s", client.clientFd, client.userTag(), timeout)
+		client.noteClose("idle timeout")
+		p.closeClient(client.clientFd)
+	}
+	p.armTimeout(client, timeout, check)
+}
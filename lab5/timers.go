@@ -0,0 +1,89 @@
+package main
+
+import (
+	"container/heap"
+	"time"
+)
+
+type timer struct {
+	when  time.Time
+	fn    func()
+	index int
+}
+
+// timerQueue is a min-heap of timers run by the event loop.
+type timerQueue []*timer
+
+func (q timerQueue) Len() int           { return len(q) }
+func (q timerQueue) Less(i, j int) bool { return q[i].when.Before(q[j].when) }
+
+func (q timerQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *timerQueue) Push(x any) {
+	t := x.(*timer)
+	t.index = len(*q)
+	*q = append(*q, t)
+}
+
+func (q *timerQueue) Pop() any {
+	old := *q
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	t.index = -1
+	return t
+}
+
+// after schedules fn to run on the event loop once d has passed.
+func (q *timerQueue) after(d time.Duration, fn func()) *timer {
+	t := &timer{when: time.Now().Add(d), fn: fn}
+	heap.Push(q, t)
+	return t
+}
+
+// stop cancels t, it is fine to stop a timer that already fired or was stopped.
+func (q *timerQueue) stop(t *timer) {
+	if t == nil || t.index < 0 {
+		return
+	}
+	heap.Remove(q, t.index)
+}
+
+// nextTimeout returns the EpollWait timeout in milliseconds until the closest timer, or -1.
+func (q *timerQueue) nextTimeout(now time.Time) int {
+	if len(*q) == 0 {
+		return -1
+	}
+	ms := (*q)[0].when.Sub(now).Milliseconds()
+	if ms < 0 {
+		return 0
+	}
+	// Round up so the loop does not wake up just before the timer is due.
+	if (*q)[0].when.After(now.Add(time.Duration(ms) * time.Millisecond)) {
+		ms++
+	}
+	return int(ms)
+}
+
+// run fires every timer that is due.
+func (q *timerQueue) run(now time.Time) {
+	for len(*q) > 0 && !now.Before((*q)[0].when) {
+		t := heap.Pop(q).(*timer)
+		t.fn()
+	}
+}
+
+// minTimeout combines two EpollWait timeouts where -1 means infinite.
+func minTimeout(a, b int) int {
+	if a < 0 {
+		return b
+	}
+	if b < 0 {
+		return a
+	}
+	return min(a, b)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+	"golang.org/x/sys/unix"
+)
+
+// Datagrams waiting for DNS are dropped once this many are queued per name.
+const maxUDPWaiting = 16
+
+// Datagrams to new targets are dropped once an association has sent to this many.
+const maxUDPPeers = 4096
+
+// startUDPAssociate allocates the relay socket for a UDP ASSOCIATE request and
+// replies with its address. expect is the source the client declared it will send from;
+// unspecified IP or zero port mean "any".
+func (p *Proxy) startUDPAssociate(client *ClientConn, expect *net.UDPAddr) error {
+	localAddr := client.localAddr
+
+	if expect.IP == nil || expect.IP.IsUnspecified() {
+		expect.IP = client.clientAddr.IP
+	}
+	client.udpExpect = expect
+
+	udpFd, relayPort, err := openUDPRelay()
+	if err != nil {
+		return err
+	}
+
+	if err := unix.EpollCtl(p.epollFd, unix.EPOLL_CTL_ADD, udpFd, &unix.EpollEvent{
+		Events: unix.EPOLLIN | unix.EPOLLET,
+		Fd:     int32(udpFd),
+	}); err != nil {
+		unix.Close(udpFd)
+		return err
+	}
+
+	client.udpFd = udpFd
+	client.udpWaiting = make(map[string][][]byte)
+	client.udpPeers = make(map[string]bool)
+	p.conns[udpFd] = client
+
+	if err := p.sendReply(client, repSuccess, localAddr.IP, relayPort); err != nil {
+		return err
+	}
+
+	client.stage = associate
+	// Datagrams are not sniffed, rules matching a server name never match them.
+	client.nameKnown = true
+	p.armIdleTimeout(client)
+	infof("Client %d%s UDP relay on %s", client.clientFd, client.userTag(),
+		net.JoinHostPort(localAddr.IP.String(), strconv.Itoa(relayPort)))
+	return nil
+}
+
+// openUDPRelay opens a non-blocking UDP socket on an ephemeral port. It is
+// dual-stack, so datagrams can be relayed to both IPv4 and IPv6 targets.
+func openUDPRelay() (fd int, port int, err error) {
+	fd, err = unix.Socket(unix.AF_INET6, unix.SOCK_DGRAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return -1, 0, err
+	}
+	if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_V6ONLY, 0); err != nil {
+		unix.Close(fd)
+		return -1, 0, err
+	}
+	if err := unix.Bind(fd, &unix.SockaddrInet6{}); err != nil {
+		unix.Close(fd)
+		return -1, 0, err
+	}
+	sa, err := unix.Getsockname(fd)
+	if err != nil {
+		unix.Close(fd)
+		return -1, 0, err
+	}
+	_, port = sockaddrToIP(sa)
+	return fd, port, nil
+}
+
+func (p *Proxy) handleUDPRelay(client *ClientConn) error {
+	for {
+		n, from, err := unix.Recvfrom(client.udpFd, p.udpBuf, 0)
+		if err != nil {
+			if errors.Is(err, unix.EAGAIN) {
+				return nil
+			}
+			return err
+		}
+
+		fromIP, fromPort := sockaddrToIP(from)
+		if fromIP == nil {
+			continue
+		}
+		fromAddr := &net.UDPAddr{IP: fromIP, Port: fromPort}
+
+		if p.isUDPClient(client, fromAddr) {
+			client.udpClientAddr = fromAddr
+			metrics.bytesRelayed.add("upload", uint64(n))
+			client.relayed[dirUpload] += int64(n)
+			p.relayUDPFromClient(client, p.udpBuf[:n])
+		} else if client.udpPeers[fromAddr.String()] {
+			metrics.bytesRelayed.add("download", uint64(n))
+			client.relayed[dirDownload] += int64(n)
+			p.relayUDPToClient(client, fromAddr, p.udpBuf[:n])
+		}
+	}
+}
+
+// isUDPClient reports whether a datagram came from the associated client rather than from a target.
+func (p *Proxy) isUDPClient(client *ClientConn, from *net.UDPAddr) bool {
+	if client.udpClientAddr != nil {
+		return client.udpClientAddr.IP.Equal(from.IP) && client.udpClientAddr.Port == from.Port
+	}
+	if !client.udpExpect.IP.Equal(from.IP) {
+		return false
+	}
+	return client.udpExpect.Port == 0 || client.udpExpect.Port == from.Port
+}
+
+func (p *Proxy) relayUDPFromClient(client *ClientConn, datagram []byte) {
+	if len(datagram) < 4 {
+		return
+	}
+	// Fragmentation is optional and we do not implement it.
+	if datagram[2] != 0 {
+		return
+	}
+
+	host, port, n, err := parseSocksAddr(datagram[3:])
+	if err != nil || n == 0 {
+		return
+	}
+	payload := datagram[3+n:]
+
+	ip := net.ParseIP(host)
+	if !p.allowed(client, host, ip, port) {
+		return
+	}
+	if ip != nil {
+		p.sendUDPToTarget(client, &net.UDPAddr{IP: ip, Port: int(port)}, payload)
+		return
+	}
+
+	// Names go through the resolver for every datagram, so its cache decides
+	// how long an answer is used.
+	key := strings.ToLower(dns.Fqdn(host))
+
+	// Keep the whole datagram, the port is parsed again once the name is resolved.
+	waiting, pending := client.udpWaiting[key]
+	if len(waiting) >= maxUDPWaiting {
+		return
+	}
+	client.udpWaiting[key] = append(waiting, append([]byte(nil), datagram...))
+	if pending {
+		return
+	}
+
+	err = p.resolver.lookup(host, dns.TypeA, func(msg *dns.Msg, err error) {
+		if client.closed {
+			return
+		}
+		if err := p.handleUDPResolved(client, key, msg, err); err != nil {
+			warnf("Client %d UDP DNS error: %v", client.clientFd, err)
+		}
+	})
+	if err != nil {
+		warnf("Client %d UDP DNS error: %v", client.clientFd, err)
+		delete(client.udpWaiting, key)
+	}
+}
+
+func (p *Proxy) relayUDPToClient(client *ClientConn, from *net.UDPAddr, payload []byte) {
+	if client.udpClientAddr == nil {
+		return
+	}
+
+	datagram := make([]byte, 0, 3+1+16+2+len(payload))
+	datagram = append(datagram, 0, 0, 0)
+	datagram = appendSocksAddr(datagram, from.IP, from.Port)
+	datagram = append(datagram, payload...)
+
+	p.sendUDP(client, client.udpClientAddr, datagram)
+}
+
+// sendUDPToTarget sends payload to a target and lets the target answer.
+func (p *Proxy) sendUDPToTarget(client *ClientConn, to *net.UDPAddr, payload []byte) {
+	peer := to.String()
+	if !client.udpPeers[peer] {
+		if len(client.udpPeers) >= maxUDPPeers {
+			debugf("Client %d UDP datagram to %s dropped, too many targets", client.clientFd, peer)
+			return
+		}
+		client.udpPeers[peer] = true
+	}
+	p.sendUDP(client, to, payload)
+}
+
+func (p *Proxy) sendUDP(client *ClientConn, to *net.UDPAddr, payload []byte) {
+	if err := unix.Sendto(client.udpFd, payload, 0, udpAddrToSockaddr(to)); err != nil {
+		warnf("Client %d UDP send to %s failed: %v", client.clientFd, to, err)
+		return
+	}
+	p.countTraffic(client, len(payload))
+}
+
+// handleUDPResolved flushes datagrams that were waiting for the name key.
+func (p *Proxy) handleUDPResolved(client *ClientConn, key string, msg *dns.Msg, err error) error {
+	waiting := client.udpWaiting[key]
+	delete(client.udpWaiting, key)
+
+	var ip net.IP
+	if err == nil {
+		ip, err = answerIP(key, msg)
+	}
+	if err != nil {
+		return fmt.Errorf("dropped %d datagrams: %w", len(waiting), err)
+	}
+
+	for _, datagram := range waiting {
+		host, port, n, err := parseSocksAddr(datagram[3:])
+		if err != nil || n == 0 || !p.allowed(client, host, ip, port) {
+			continue
+		}
+		p.sendUDPToTarget(client, &net.UDPAddr{IP: ip, Port: int(port)}, datagram[3+n:])
+	}
+	return nil
+}
+
+// udpAddrToSockaddr always returns an IPv6 sockaddr since relay sockets are dual-stack.
+func udpAddrToSockaddr(addr *net.UDPAddr) unix.Sockaddr {
+	sa := &unix.SockaddrInet6{Port: addr.Port}
+	copy(sa.Addr[:], addr.IP.To16())
+	return sa
+}
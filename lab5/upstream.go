@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	upstreamSOCKS5 = "socks5"
+	upstreamHTTP   = "http"
+
+	// routeDirect is the route name connecting without an upstream.
+	routeDirect = "direct"
+	// defaultUpstream is the name -upstream gives its proxy.
+	defaultUpstream = "default"
+
+	maxUpstreamHeaderSize = 8 * 1024
+)
+
+// upstreamProxy is a next-hop proxy CONNECT requests can be sent through.
+type upstreamProxy struct {
+	name     string
+	kind     string
+	host     string
+	port     uint16
+	user     string
+	password string
+}
+
+// upstreamRoute sends the requests its rule matches through upstream, or directly if it is nil.
+type upstreamRoute struct {
+	rule     *aclRule
+	upstream *upstreamProxy
+}
+
+// Steps of the handshake with an upstream, each waits for one response.
+const (
+	upstreamMethod = iota
+	upstreamLogin
+	upstreamConnect
+)
+
+// upstreamHandshake is the state of a session while the upstream sets up the
+// connection to the target. out waits to be written, in collects the response
+// to the current step.
+type upstreamHandshake struct {
+	step    int
+	out     []byte
+	in      []byte
+	started time.Time
+}
+
+// upstreamError is a refusal by the upstream, passed on to the client as rep.
+type upstreamError struct {
+	rep byte
+	msg string
+}
+
+func (e *upstreamError) Error() string {
+	return e.msg
+}
+
+// parseUpstreamURL reads an upstream given as socks5://[user:password@]host:port
+// or http://[user:password@]host:port.
+func parseUpstreamURL(value string) (Upstream, error) {
+	u, err := url.Parse(value)
+	if err != nil {
+		return Upstream{}, err
+	}
+	if u.Path != "" && u.Path != "/" || u.RawQuery != "" {
+		return Upstream{}, fmt.Errorf("upstream URL %q must not have a path or query", value)
+	}
+	upstream := Upstream{Type: u.Scheme, Address: u.Host}
+	if u.User != nil {
+		upstream.Username = u.User.Username()
+		upstream.Password, _ = u.User.Password()
+	}
+	return upstream, nil
+}
+
+// parseRoutes reads the routes of cfg, "NAME CONDITIONS" lines where NAME is an
+// upstream or "direct" and the conditions are those of ACL rules.
+func parseRoutes(cfg *Config) ([]upstreamRoute, error) {
+	upstreams := make(map[string]*upstreamProxy)
+	for name, u := range cfg.Upstreams {
+		// validate checked the address.
+		host, portStr, _ := net.SplitHostPort(u.Address)
+		port, _ := strconv.ParseUint(portStr, 10, 16)
+		upstreams[name] = &upstreamProxy{name: name, kind: u.Type, host: host, port: uint16(port),
+			user: u.Username, password: u.Password}
+	}
+
+	var routes []upstreamRoute
+	for i, line := range cfg.Routes {
+		name, conditions, _ := strings.Cut(strings.TrimSpace(line), " ")
+		var route upstreamRoute
+		if name != routeDirect {
+			if route.upstream = upstreams[name]; route.upstream == nil {
+				return nil, fmt.Errorf("route %d: unknown upstream %q", i+1, name)
+			}
+		}
+		rule, err := parseACLRule("allow " + conditions)
+		if err != nil {
+			return nil, fmt.Errorf("route %d: %w", i+1, err)
+		}
+		if len(rule.names) > 0 {
+			return nil, fmt.Errorf("route %d: the server name is not known yet when routing", i+1)
+		}
+		rule.line = i + 1
+		route.rule = rule
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// selectUpstream returns the upstream of the first route matching the request
+// of client, or nil to connect directly. Targets are not resolved for routing,
+// so "to" networks only match targets given as addresses.
+func (p *Proxy) selectUpstream(client *ClientConn) *upstreamProxy {
+	req := aclRequest{client: client.clientIP(), user: client.user, host: client.targetHost,
+		ip: net.ParseIP(client.targetHost), port: client.targetPort, unresolved: true}
+	for _, route := range p.routes {
+		if matched, known := route.rule.match(req); matched && known {
+			return route.upstream
+		}
+	}
+	return nil
+}
+
+// startUpstreamHandshake asks the upstream client is connected to for the target.
+// The session stays in the connecting stage, under the connect timeout, until
+// the upstream reports success.
+func (p *Proxy) startUpstreamHandshake(client *ClientConn, started time.Time) error {
+	u := client.upstream
+	hs := &upstreamHandshake{step: upstreamConnect, started: started}
+	switch u.kind {
+	case upstreamSOCKS5:
+		hs.step = upstreamMethod
+		hs.out = []byte{socksVersion5, 1, authNone}
+		if u.user != "" {
+			hs.out = []byte{socksVersion5, 2, authNone, authUserPass}
+		}
+	case upstreamHTTP:
+		target := net.JoinHostPort(client.targetHost, strconv.Itoa(int(client.targetPort)))
+		req := "CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n"
+		if u.user != "" {
+			req += "Proxy-Authorization: Basic " +
+				base64.StdEncoding.EncodeToString([]byte(u.user+":"+u.password)) + "\r\n"
+		}
+		hs.out = []byte(req + "\r\n")
+	}
+	client.upstreamState = hs
+
+	if err := flushTo(client.remoteFd, &hs.out); err != nil {
+		return p.failUpstream(client, err)
+	}
+	return p.updateInterest(client)
+}
+
+// handleUpstreamEvent drives the upstream handshake of client.
+func (p *Proxy) handleUpstreamEvent(client *ClientConn, events uint32) error {
+	hs := client.upstreamState
+	if events&unix.EPOLLERR != 0 {
+		soErr, _ := unix.GetsockoptInt(client.remoteFd, unix.SOL_SOCKET, unix.SO_ERROR)
+		return p.failUpstream(client, fmt.Errorf("connection error: %w", unix.Errno(soErr)))
+	}
+	if events&unix.EPOLLOUT != 0 {
+		if err := flushTo(client.remoteFd, &hs.out); err != nil {
+			return p.failUpstream(client, err)
+		}
+	}
+	if events&(unix.EPOLLIN|unix.EPOLLHUP) != 0 {
+		done, err := p.readUpstream(client)
+		if err != nil {
+			return p.failUpstream(client, err)
+		}
+		if done {
+			client.upstreamState = nil
+			metrics.connectDuration.observe(time.Since(hs.started))
+			return p.establishRemote(client, "upstream "+client.upstream.name)
+		}
+	}
+	return p.updateInterest(client)
+}
+
+// readUpstream reads the response to the current step and answers it. It never
+// reads past the response, what follows already comes from the target.
+// done is set once the upstream is connected to the target.
+func (p *Proxy) readUpstream(client *ClientConn) (done bool, err error) {
+	hs := client.upstreamState
+	if client.upstream.kind == upstreamHTTP {
+		return p.readUpstreamHTTP(client)
+	}
+
+	need := 2
+	if hs.step == upstreamConnect {
+		if need, err = socks5ReplySize(hs.in); err != nil {
+			return false, err
+		}
+	}
+	n, err := unix.Read(client.remoteFd, p.relayBuf[:need-len(hs.in)])
+	if err != nil {
+		if errors.Is(err, unix.EAGAIN) {
+			return false, nil
+		}
+		return false, err
+	}
+	if n == 0 {
+		return false, errors.New("connection closed during the handshake")
+	}
+	hs.in = append(hs.in, p.relayBuf[:n]...)
+	if hs.step == upstreamConnect {
+		// The size of the reply is known after its first five bytes.
+		if need, err = socks5ReplySize(hs.in); err != nil {
+			return false, err
+		}
+	}
+	if len(hs.in) < need {
+		return false, nil
+	}
+
+	resp := hs.in
+	hs.in = nil
+	if resp[0] != socksVersion5 && hs.step != upstreamLogin {
+		return false, fmt.Errorf("unexpected SOCKS version %d", resp[0])
+	}
+	switch hs.step {
+	case upstreamMethod:
+		switch {
+		case resp[1] == authNone:
+		case resp[1] == authUserPass && client.upstream.user != "":
+			u := client.upstream
+			hs.step = upstreamLogin
+			hs.out = append(hs.out, userPassVersion, byte(len(u.user)))
+			hs.out = append(hs.out, u.user...)
+			hs.out = append(hs.out, byte(len(u.password)))
+			hs.out = append(hs.out, u.password...)
+			return false, flushTo(client.remoteFd, &hs.out)
+		case resp[1] == authNoAcceptable:
+			return false, errors.New("no acceptable authentication method")
+		default:
+			return false, fmt.Errorf("unexpected authentication method %d", resp[1])
+		}
+	case upstreamLogin:
+		if resp[1] != userPassSuccess {
+			return false, fmt.Errorf("login as %q refused", client.upstream.user)
+		}
+	case upstreamConnect:
+		if resp[1] != repSuccess {
+			return false, &upstreamError{rep: resp[1], msg: fmt.Sprintf("refused with reply %d", resp[1])}
+		}
+		return true, nil
+	}
+
+	req, err := socks5ConnectRequest(client.targetHost, client.targetPort)
+	if err != nil {
+		return false, err
+	}
+	hs.step = upstreamConnect
+	hs.out = append(hs.out, req...)
+	return false, flushTo(client.remoteFd, &hs.out)
+}
+
+// readUpstreamHTTP reads the response header to CONNECT. The data is peeked
+// first to take no more than the header from the socket.
+func (p *Proxy) readUpstreamHTTP(client *ClientConn) (bool, error) {
+	hs := client.upstreamState
+	buf := p.relayBuf[:maxUpstreamHeaderSize-len(hs.in)]
+	n, _, err := unix.Recvfrom(client.remoteFd, buf, unix.MSG_PEEK)
+	if err != nil {
+		if errors.Is(err, unix.EAGAIN) {
+			return false, nil
+		}
+		return false, err
+	}
+	if n == 0 {
+		return false, errors.New("connection closed during the handshake")
+	}
+
+	take := n
+	end := bytes.Index(append(hs.in, buf[:n]...), []byte("\r\n\r\n"))
+	if end >= 0 {
+		take = end + 4 - len(hs.in)
+	}
+	if n, err = unix.Read(client.remoteFd, buf[:take]); err != nil {
+		return false, err
+	}
+	hs.in = append(hs.in, buf[:n]...)
+	if end < 0 {
+		if len(hs.in) >= maxUpstreamHeaderSize {
+			return false, errors.New("response header too large")
+		}
+		return false, nil
+	}
+
+	statusLine, _, _ := strings.Cut(string(hs.in), "\r\n")
+	proto, status, _ := strings.Cut(statusLine, " ")
+	codeStr, _, _ := strings.Cut(status, " ")
+	code, err := strconv.Atoi(codeStr)
+	if !strings.HasPrefix(proto, "HTTP/1.") || err != nil {
+		return false, fmt.Errorf("bad response %q", statusLine)
+	}
+	if code/100 != 2 {
+		return false, &upstreamError{rep: httpStatusReply(code), msg: "refused with " + status}
+	}
+	return true, nil
+}
+
+// failUpstream fails the request of client because of the upstream.
+func (p *Proxy) failUpstream(client *ClientConn, err error) error {
+	return p.failRequest(client, fmt.Errorf("upstream %s: %w", client.upstream.name, err))
+}
+
+// socks5ReplySize returns the size of a SOCKS5 reply starting with b.
+func socks5ReplySize(b []byte) (int, error) {
+	if len(b) < 5 {
+		return 5, nil
+	}
+	switch b[3] {
+	case atypIP4:
+		return 4 + net.IPv4len + 2, nil
+	case atypIP6:
+		return 4 + net.IPv6len + 2, nil
+	case atypDomain:
+		return 4 + 1 + int(b[4]) + 2, nil
+	}
+	return 0, fmt.Errorf("unexpected address type %d in reply", b[3])
+}
+
+func socks5ConnectRequest(host string, port uint16) ([]byte, error) {
+	req := []byte{socksVersion5, cmdConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("%w: host name longer than 255 bytes", errAddrNotSupported)
+		}
+		req = append(req, atypDomain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(append(req, atypIP4), ip4...)
+	} else {
+		req = append(append(req, atypIP6), ip.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(req, port), nil
+}
+
+// httpStatusReply maps the status an HTTP upstream refused CONNECT with to a reply code.
+func httpStatusReply(status int) byte {
+	switch status {
+	case http.StatusForbidden:
+		return repNotAllowed
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return repHostUnreachable
+	case http.StatusGatewayTimeout:
+		return repTTLExpired
+	}
+	return repGeneralFailure
+}